@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+const (
+	// maxChanges limits how many changed states from an update are kept in the salt state.
+	maxChanges = 500
+	// maxChangeDiffBytes limits the size of the changes kept for each changed state.
+	maxChangeDiffBytes = 4 * 1024
+)
+
+// parseChanges finds the states that made changes in the output of a salt call.
+// With --state-output=mixed the changed states are printed as a full block with the changes,
+// a diff with --output-diff, indented under the Changes key:
+//
+//	----------
+//	          ID: /etc/cacophony/config.toml
+//	    Function: file.managed
+//	        Name: /etc/cacophony/config.toml
+//	      Result: True
+//	     Comment: File /etc/cacophony/config.toml updated
+//	     Started: 15:14:08.001311
+//	    Duration: 10.327 ms
+//	     Changes:
+//	              ----------
+//	              diff:
+//	                  ---
+//	                  +++
+//	                  @@ -1 +1 @@
+//	                  -a
+//	                  +b
+//
+// With --state-output=terse changed states have the result "Changed" and no changes are shown.
+func parseChanges(out string, jsonSummary *saltJSONSummary) []saltrequester.ChangeItem {
+	if jsonSummary != nil {
+		return limitChanges(jsonSummary.Changes)
+	}
+	changes := []saltrequester.ChangeItem{}
+	var current *saltrequester.ChangeItem
+	var changeLines []string
+	changesIndent := -1
+	addCurrent := func() {
+		if current != nil && changesIndent >= 0 {
+			current.Diff = dedent(changeLines)
+			if current.Diff != "" {
+				changes = append(changes, *current)
+			}
+		}
+		changeLines = nil
+		changesIndent = -1
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if changesIndent >= 0 {
+			// The changes are everything indented more than the Changes key.
+			if trimmed == "" || indent > changesIndent {
+				changeLines = append(changeLines, line)
+				continue
+			}
+			addCurrent()
+			current = nil
+		}
+		if state, ok := parseTerseState(trimmed); ok {
+			current = nil
+			if state.Result == "Changed" {
+				changes = append(changes, saltrequester.ChangeItem{Function: state.Function, Name: state.Name})
+			}
+			continue
+		}
+		key, value, found := strings.Cut(trimmed, ":")
+		if !found || strings.Contains(key, " ") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "ID":
+			current = &saltrequester.ChangeItem{ID: value}
+		case "Function":
+			if current != nil {
+				current.Function = value
+			}
+		case "Name":
+			if current != nil {
+				current.Name = value
+			}
+		case "Changes":
+			if current != nil {
+				changesIndent = indent
+			}
+		}
+	}
+	addCurrent()
+	return limitChanges(changes)
+}
+
+// limitChanges limits the number of changes and the size of each diff.
+func limitChanges(changes []saltrequester.ChangeItem) []saltrequester.ChangeItem {
+	if len(changes) > maxChanges {
+		changes = changes[:maxChanges]
+	}
+	for i := range changes {
+		if len(changes[i].Diff) > maxChangeDiffBytes {
+			changes[i].Diff = changes[i].Diff[:maxChangeDiffBytes] + "\n..."
+		}
+	}
+	return changes
+}
+
+// dedent joins the lines after removing their common indentation and the blank lines around them.
+func dedent(lines []string) string {
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	minIndent := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if minIndent < 0 || indent < minIndent {
+			minIndent = indent
+		}
+	}
+	for i, line := range lines {
+		if len(line) >= minIndent {
+			lines[i] = line[minIndent:]
+		} else {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n")
+}
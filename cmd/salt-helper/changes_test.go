@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+	"github.com/stretchr/testify/assert"
+)
+
+const testOutMixedChanges = `local:
+----------
+          ID: /etc/cacophony/config.toml
+    Function: file.managed
+        Name: /etc/cacophony/config.toml
+      Result: True
+     Comment: File /etc/cacophony/config.toml updated
+     Started: 15:14:08.001311
+    Duration: 10.327 ms
+     Changes:
+              ----------
+              diff:
+                  ---
+                  +++
+                  @@ -1,2 +1,2 @@
+                   [thermal-recorder]
+                  -use-low-power-mode = false
+                  +use-low-power-mode = true
+----------
+          ID: audiobait
+    Function: pkg.installed
+        Name: audiobait
+      Result: True
+     Comment: All specified packages are already installed
+     Started: 15:14:10.120312
+    Duration: 24.5 ms
+     Changes:
+  Name: systemctl restart stay-on - Function: cmd.run - Result: Changed Started: - 15:14:07.884464 Duration: 79.173 ms
+  Name: /etc/salt/minion - Function: file.managed - Result: Clean Started: - 15:14:18.582478 Duration: 28.601 ms
+
+Summary for local
+--------------
+Succeeded: 4 (changed=2)
+Failed:    0
+--------------
+Total states run:     4
+Total run time:   0.142 s`
+
+func TestParseChanges(t *testing.T) {
+	assert.Equal(t, []saltrequester.ChangeItem{
+		{
+			ID:       "/etc/cacophony/config.toml",
+			Function: "file.managed",
+			Name:     "/etc/cacophony/config.toml",
+			Diff: "----------\ndiff:\n    ---\n    +++\n    @@ -1,2 +1,2 @@\n     [thermal-recorder]\n" +
+				"    -use-low-power-mode = false\n    +use-low-power-mode = true",
+		},
+		{Function: "cmd.run", Name: "systemctl restart stay-on"},
+	}, parseChanges(testOutMixedChanges, nil))
+
+	assert.Len(t, parseChanges(testOutSuccess, nil), 5)
+	assert.Empty(t, parseChanges(testOutNoChanges, nil))
+
+	jsonSummary, ok := parseSaltJSON(testOutJSON)
+	assert.True(t, ok)
+	assert.Equal(t, []saltrequester.ChangeItem{{
+		ID:       "restart-stay-on",
+		Function: "cmd.run",
+		Name:     "systemctl restart stay-on",
+		Diff:     "{\n  \"pid\": 1234,\n  \"retcode\": 0,\n  \"stderr\": \"\",\n  \"stdout\": \"\"\n}",
+	}}, parseChanges(testOutJSON, jsonSummary))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// Results of the check-for-update command.
+const (
+	checkResultUpdateAvailable  = "update-available"
+	checkResultUpToDate         = "up-to-date"
+	checkResultNodegroupChange  = "nodegroup-change"
+	checkResultOffline          = "offline"
+	checkResultUnknownNodegroup = "unknown-nodegroup"
+	checkResultKeyNotAccepted   = "minion-key-not-accepted"
+)
+
+// checkForUpdateResult is the machine readable result of the check-for-update command.
+type checkForUpdateResult struct {
+	Result          string    `json:"result"`
+	MinionKeyStatus string    `json:"minionKeyStatus,omitempty"`
+	UpdateAvailable bool      `json:"updateAvailable"`
+	Nodegroup       string    `json:"nodegroup"`
+	LastUpdate      time.Time `json:"lastUpdate"`
+	LastAttempt     time.Time `json:"lastAttempt"`
+	LatestCommit    time.Time `json:"latestCommit"`
+	LatestVersion   string    `json:"latestVersion,omitempty"`
+	LatestCommitSHA string    `json:"latestCommitSHA,omitempty"`
+}
+
+// checkForUpdateCommand checks if a salt update is recommended, logging the details.
+// A nodegroup change recommends an update even if there is no new saltops commit.
+func checkForUpdateCommand() (*checkForUpdateResult, error) {
+	// Updates do nothing until the salt master has accepted the minion key.
+	// Other statuses, like no response when offline, don't show the key isn't accepted.
+	_, keyStatus, err := saltrequester.MinionKeyAccepted()
+	if err != nil {
+		log.Errorf("Failed to check if the minion key is accepted: %v", err)
+	} else if keyStatus == minionKeyPending || keyStatus == minionKeyRejected {
+		log.Warnf("Minion key is not accepted by the salt master (%s), accept the key on the salt master.", keyStatus)
+		return &checkForUpdateResult{Result: checkResultKeyNotAccepted, MinionKeyStatus: keyStatus}, nil
+	}
+
+	// Check for the nodegroup changing
+	nodegroupChange, err := checkNodeGroupChange()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if nodegroupChange {
+		log.Info("Found nodegroup change, recommend a salt update.")
+		return &checkForUpdateResult{Result: checkResultNodegroupChange, MinionKeyStatus: keyStatus, UpdateAvailable: true}, nil
+	}
+
+	// Log last time a update was run.
+	state, err := saltrequester.State()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get salt state, %v", err)
+	}
+	nodegroup := state.LastCallNodegroup
+	result := &checkForUpdateResult{
+		MinionKeyStatus: keyStatus,
+		Nodegroup:       nodegroup,
+		LastUpdate:      state.LastUpdate,
+		LastAttempt:     state.LastAttempt,
+	}
+	log.Printf("Last successful update was run at '%s', with nodegroup '%s'", state.LastUpdate.Format("2006-01-02 15:04:05"), nodegroup)
+	log.Printf("Last update attempt was at '%s'", state.LastAttempt.Format("2006-01-02 15:04:05"))
+
+	// Log when the latest software was released.
+	latestUpdate, err := saltrequester.GetLatestUpdateInfo(nodegroup)
+	if errors.Is(err, saltrequester.ErrOffline) {
+		log.Info("Device is offline, can't check for an update.")
+		result.Result = checkResultOffline
+		return result, nil
+	}
+	if errors.Is(err, saltrequester.ErrUnknownNodegroup) {
+		log.Infof("Unknown nodegroup, skipping update check: %v", err)
+		result.Result = checkResultUnknownNodegroup
+		return result, nil
+	}
+	if err != nil {
+		log.Errorf("Error getting latest update time: %v", err)
+		return nil, err
+	}
+	result.LatestCommit = latestUpdate.CommitDate
+	result.LatestVersion = latestUpdate.Version
+	result.LatestCommitSHA = latestUpdate.CommitSHA
+	log.Printf("Latest software update was published at '%s', for nodegroup '%s'", latestUpdate.CommitDate.Format("2006-01-02 15:04:05"), nodegroup)
+	if latestUpdate.CommitSHA != "" {
+		log.Printf("Latest commit is '%s', last update applied commit '%s'", latestUpdate.CommitSHA, state.LastUpdateSHA)
+	}
+	if latestUpdate.Version != "" {
+		log.Printf("Latest version is '%s', last update applied version '%s'", latestUpdate.Version, state.LastUpdateVersion)
+	}
+	if saltrequester.IsUpdateAvailable(latestUpdate, state) {
+		log.Info("Found new update, recommend a salt update.")
+		result.Result = checkResultUpdateAvailable
+		result.UpdateAvailable = true
+	} else {
+		log.Info("No new update found, nothing to do.")
+		result.Result = checkResultUpToDate
+	}
+	return result, nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// saltConfig is the salt section of the config. It extends goconfig.Salt with
+// the settings that are only used by salt-helper.
+type saltConfig struct {
+	goconfig.Salt      `mapstructure:",squash"`
+	RandomDelayMinutes int    `mapstructure:"random-delay-minutes"`
+	PinnedRef          string `mapstructure:"pinned-ref"`
+	// ShutdownGraceSeconds is how long to wait for a running salt call to finish when the service is stopped.
+	ShutdownGraceSeconds int `mapstructure:"shutdown-grace-seconds"`
+	// MinSaltVersions is the minimum salt minion version needed for each saltops branch.
+	MinSaltVersions map[string]string `mapstructure:"min-salt-versions"`
+	// EventOutMaxBytes is the most of the salt call output added to a salt-update event, 0 for no limit.
+	EventOutMaxBytes int `mapstructure:"event-out-max-bytes"`
+	// LastCallOutMaxBytes is the most of the last salt call output kept in the salt state, 0 for no limit.
+	LastCallOutMaxBytes int `mapstructure:"last-call-out-max-bytes"`
+	// StateFileOutMaxBytes is the most of the last salt call output saved in the state file, 0 for no limit.
+	// The output kept in memory, up to LastCallOutMaxBytes, can be read with GetLastOutput, and
+	// the end of the output of a failed update is in its salt-update event.
+	StateFileOutMaxBytes int `mapstructure:"state-file-out-max-bytes"`
+	// ModemConnectAction is what is run when the modem connects, "ping", "check-for-update" or "none".
+	ModemConnectAction string `mapstructure:"modem-connect-action"`
+	// ModemConnectDebounceMinutes is the minimum time between running the modem connect action.
+	ModemConnectDebounceMinutes int `mapstructure:"modem-connect-debounce-minutes"`
+	// Channel is the update channel, "stable" or "beta". See saltrequester.ResolveBranch.
+	// A pinned ref takes precedence over the channel.
+	Channel string `mapstructure:"channel"`
+	// BranchOverride is a saltops branch used instead of the branch from the nodegroup and channel,
+	// e.g. for canary testing a branch on some devices. A pinned ref takes precedence over it.
+	BranchOverride string `mapstructure:"branch-override"`
+	// UpdateOnNodegroupChange runs an update in the run-dbus loop when the nodegroup has changed
+	// since the last salt call, if auto update is on.
+	UpdateOnNodegroupChange bool `mapstructure:"update-on-nodegroup-change"`
+	// StateOutput is the salt --state-output format for updates, "terse" gives the smallest output.
+	// The summary used in the salt-update event is printed in all formats. Failed state details
+	// are parsed from the full, mixed, changes and terse formats, terse has no comment or ID.
+	StateOutput string `mapstructure:"state-output"`
+	// OutputFormat is the salt-call output format for updates, "text" or "json". With "json" the
+	// results of each state are parsed from the JSON output instead of the text summary, the state
+	// output and output diff settings aren't used.
+	OutputFormat string `mapstructure:"output-format"`
+	// OutputDiff adds --output-diff to updates so changes are shown as a diff.
+	OutputDiff bool `mapstructure:"output-diff"`
+	// DefaultTotalStates is the number of states assumed to be in an update when estimating
+	// progress, used until an update has succeeded and the real number is known.
+	DefaultTotalStates int `mapstructure:"default-total-states"`
+	// ProgressEventMilestones are the update progress percentages a salt-update-progress event
+	// is sent at, e.g. [25, 50, 75]. No progress events are sent if empty.
+	ProgressEventMilestones []int `mapstructure:"progress-event-milestones"`
+	// ProgressEventMinSeconds is the minimum time between salt-update-progress events.
+	ProgressEventMinSeconds int `mapstructure:"progress-event-min-seconds"`
+	// HeartbeatFile has the time of the last heartbeat from the run-dbus loop written to it,
+	// so a watchdog can restart the service if the loop stops.
+	HeartbeatFile string `mapstructure:"heartbeat-file"`
+	// PingEvents sends a salt-ping event with the result of each salt ping, or a salt-modem-ping
+	// event for the salt ping after the modem connects.
+	PingEvents bool `mapstructure:"ping-events"`
+	// MinionLogFile is the salt minion log that is followed to track the progress of an update.
+	MinionLogFile string `mapstructure:"minion-log-file"`
+	// HTTPProxy is the proxy URL used when checking for updates. If empty the proxy
+	// environment variables are used.
+	HTTPProxy string `mapstructure:"http-proxy"`
+	// SaltCallArgs are global salt-call args added to updates, pings and local applies, e.g. "--log-level=debug".
+	// Only the args allowed by validateSaltCallArg are used. The output format flags used for
+	// parsing the salt call output can't be set here, see OutputFormat, StateOutput and OutputDiff.
+	// Note a console log level lower than "warning" adds log lines to the salt call output.
+	SaltCallArgs []string `mapstructure:"salt-call-args"`
+	// UpdateCheckDisabled stops checking online if there is an update, every update then runs
+	// salt and leaves it to the salt master. Used where GitHub can't be reached.
+	UpdateCheckDisabled bool `mapstructure:"update-check-disabled"`
+	// VersionInfoURL and CommitsURL replace the GitHub URLs used to check for an update, e.g. with a mirror.
+	VersionInfoURL string `mapstructure:"version-info-url"`
+	CommitsURL     string `mapstructure:"commits-url"`
+	// HTTPTimeoutSeconds is the timeout for requests when checking for an update.
+	HTTPTimeoutSeconds int `mapstructure:"http-timeout-seconds"`
+	// ModuleWhitelist are the salt functions that can be run with RunModule. Only add read only
+	// functions as they can be run by anything that can use the dbus service.
+	ModuleWhitelist []string `mapstructure:"module-whitelist"`
+	// MinFreeDiskMB is the free disk space needed on each of DiskSpacePaths for an update to run.
+	// An update that installs packages can fill the disk and stop the device booting. 0 disables the check.
+	MinFreeDiskMB int `mapstructure:"min-free-disk-mb"`
+	// DiskSpacePaths are the paths checked for free space before an update, salt writes to these.
+	DiskSpacePaths []string `mapstructure:"disk-space-paths"`
+	// HTTPConnectTimeoutSeconds is the timeout for connecting when checking for an update.
+	HTTPConnectTimeoutSeconds int `mapstructure:"http-connect-timeout-seconds"`
+	// UpdateCheckCacheMinutes is how long an update check result is reused for. The results are
+	// saved next to the state file so the service and commands like check-for-update share them.
+	UpdateCheckCacheMinutes int `mapstructure:"update-check-cache-minutes"`
+	// Masterless runs every salt call with --local for devices without a salt master. Updates
+	// apply the states from the minion's local file roots and a ping only checks the minion
+	// runs. Checking for an update still uses the version info.
+	Masterless bool `mapstructure:"masterless"`
+	// UpdateWindowStart and UpdateWindowEnd are the hours, 0-23, that scheduled updates can run
+	// between in UpdateWindowTimezone, the local timezone if empty. The window can go past midnight.
+	// A window with the same start and end hour is always open.
+	UpdateWindowStart    int    `mapstructure:"update-window-start"`
+	UpdateWindowEnd      int    `mapstructure:"update-window-end"`
+	UpdateWindowTimezone string `mapstructure:"update-window-timezone"`
+	// EventTypeSuffix is added to the type of every event, e.g. "-prod" sends "salt-update-prod"
+	// and "salt-ping-prod" events, so deployments can route their events separately.
+	EventTypeSuffix string `mapstructure:"event-type-suffix"`
+	// RepeatedFailureThreshold is the number of consecutive failed updates that sends a
+	// salt-update-repeated-failure event, so a device that keeps failing can be alerted on. 0 disables it.
+	RepeatedFailureThreshold int `mapstructure:"repeated-failure-threshold"`
+	// SaltCallNice is the niceness, 1-19, salt calls are run with so an update doesn't take CPU time
+	// from the camera. 0 runs salt calls at the normal priority.
+	SaltCallNice int `mapstructure:"salt-call-nice"`
+	// SaltCallLowIOPriority runs salt calls with the lowest best-effort IO priority using ionice.
+	SaltCallLowIOPriority bool `mapstructure:"salt-call-low-io-priority"`
+	// UpdateCheckIntervalHours is the time between scheduled update checks in the run-dbus loop.
+	// A failed update is retried sooner, backing off up to this interval.
+	UpdateCheckIntervalHours int `mapstructure:"update-check-interval-hours"`
+	// ModemPingRetries is how many times a failed salt ping after the modem connects is retried,
+	// the minion can take a little while to reconnect to the master.
+	ModemPingRetries int `mapstructure:"modem-ping-retries"`
+	// ModemPingRetryDelaySeconds is the time between retries of the salt ping after the modem connects.
+	ModemPingRetryDelaySeconds int `mapstructure:"modem-ping-retry-delay-seconds"`
+}
+
+var validStateOutputs = []string{"full", "terse", "mixed", "changes", "filter"}
+
+const (
+	modemConnectActionPing           = "ping"
+	modemConnectActionCheckForUpdate = "check-for-update"
+	modemConnectActionNone           = "none"
+)
+
+func defaultSaltConfig() saltConfig {
+	return saltConfig{
+		Salt:                        goconfig.DefaultSalt(),
+		ShutdownGraceSeconds:        60,
+		EventOutMaxBytes:            8 * 1024,
+		LastCallOutMaxBytes:         256 * 1024,
+		StateFileOutMaxBytes:        32 * 1024,
+		ModemConnectAction:          modemConnectActionPing,
+		ModemConnectDebounceMinutes: 10,
+		ModemPingRetries:            2,
+		UpdateCheckIntervalHours:    24,
+		RepeatedFailureThreshold:    3,
+		ModemPingRetryDelaySeconds:  15,
+		Channel:                     saltrequester.ChannelStable,
+		OutputFormat:                "text",
+		StateOutput:                 "mixed",
+		OutputDiff:                  true,
+		UpdateCheckCacheMinutes:     5,
+		UpdateOnNodegroupChange:     true,
+		HTTPTimeoutSeconds:          10,
+		HTTPConnectTimeoutSeconds:   5,
+		MinFreeDiskMB:               200,
+		ModuleWhitelist:             []string{"disk.usage", "status.uptime", "status.loadavg", "status.meminfo", "test.version"},
+		DiskSpacePaths:              []string{"/", "/var"},
+		MinionLogFile:               "/var/log/salt/minion",
+		HeartbeatFile:               "/run/salt-helper.heartbeat",
+		DefaultTotalStates:          100,
+		ProgressEventMinSeconds:     60,
+	}
+}
+
+func readSaltConfig() (*saltConfig, error) {
+	config, err := goconfig.New(configDir)
+	if err != nil {
+		return nil, err
+	}
+	saltSetup := defaultSaltConfig()
+	if err := config.Unmarshal(goconfig.SaltKey, &saltSetup); err != nil {
+		return nil, err
+	}
+	return &saltSetup, nil
+}
+
+// loadSaltConfig reads the salt config, falling back to the default config if it can't be read.
+func loadSaltConfig() *saltConfig {
+	saltSetup, err := readSaltConfig()
+	if err != nil {
+		log.Errorf("Failed to read salt config, using defaults: %v", err)
+		defaultSetup := defaultSaltConfig()
+		return &defaultSetup
+	}
+	return saltSetup
+}
+
+// updateSaltConfig writes the given keys to the salt section of the config. Only the keys that
+// are already in the config file and the given keys are written, so the defaults of the settings
+// that haven't been set aren't saved to the config.
+func updateSaltConfig(values map[string]interface{}) error {
+	config, err := goconfig.New(configDir)
+	if err != nil {
+		return err
+	}
+	saltSection := map[string]interface{}{}
+	if err := config.Unmarshal(goconfig.SaltKey, &saltSection); err != nil {
+		return err
+	}
+	delete(saltSection, "updated")
+	for key, value := range values {
+		saltSection[key] = value
+	}
+	return config.Set(goconfig.SaltKey, saltSection)
+}
+
+// reloadSaltConfig reads the salt config and applies it to the running service. Settings read
+// for each update, like auto update, already apply from the next update, this also applies the
+// settings that are otherwise only read before a scheduled update. The service also wakes the
+// run-dbus loop so a new update check interval is used for the next scheduled update.
+func reloadSaltConfig() error {
+	saltSetup, err := readSaltConfig()
+	if err != nil {
+		return err
+	}
+	applySaltConfig(saltSetup)
+	log.Printf("Reloaded salt config: %+v", *saltSetup)
+	return nil
+}
+
+// applySaltConfig sets the package settings that are read from the salt config. It is called on
+// start and before each scheduled update so config changes apply without a restart.
+func applySaltConfig(saltSetup *saltConfig) {
+	eventOutMaxBytes = saltSetup.EventOutMaxBytes
+	lastCallOutMaxBytes = saltSetup.LastCallOutMaxBytes
+	stateFileOutMaxBytes = saltSetup.StateFileOutMaxBytes
+	eventTypeSuffix = strings.TrimSpace(saltSetup.EventTypeSuffix)
+	repeatedFailureThreshold = saltSetup.RepeatedFailureThreshold
+	pingEvents = saltSetup.PingEvents
+	saltCallNice = saltSetup.SaltCallNice
+	saltCallLowIOPriority = saltSetup.SaltCallLowIOPriority
+	modemPingRetries = saltSetup.ModemPingRetries
+	modemPingRetryDelay = time.Duration(saltSetup.ModemPingRetryDelaySeconds) * time.Second
+	updateCheckPeriod = time.Duration(defaultSaltConfig().UpdateCheckIntervalHours) * time.Hour
+	if saltSetup.UpdateCheckIntervalHours > 0 {
+		updateCheckPeriod = time.Duration(saltSetup.UpdateCheckIntervalHours) * time.Hour
+	}
+	saltrequester.UpdateCheckCacheTTL = time.Duration(saltSetup.UpdateCheckCacheMinutes) * time.Minute
+	saltrequester.HTTPProxy = saltSetup.HTTPProxy
+	saltrequester.HTTPTimeout = time.Duration(saltSetup.HTTPTimeoutSeconds) * time.Second
+	saltrequester.HTTPConnectTimeout = time.Duration(saltSetup.HTTPConnectTimeoutSeconds) * time.Second
+	saltrequester.VersionInfoURL = saltrequester.DefaultVersionInfoURL
+	if saltSetup.VersionInfoURL != "" {
+		saltrequester.VersionInfoURL = saltSetup.VersionInfoURL
+	}
+	saltrequester.CommitsURL = saltrequester.DefaultCommitsURL
+	if saltSetup.CommitsURL != "" {
+		saltrequester.CommitsURL = saltSetup.CommitsURL
+	}
+}
+
+func setAutoUpdate(enable bool) error {
+	return updateSaltConfig(map[string]interface{}{"auto-update": enable})
+}
+
+func isAutoUpdateOn() (bool, error) {
+	saltSetup, err := readSaltConfig()
+	if err != nil {
+		return false, err
+	}
+	return saltSetup.AutoUpdate, nil
+}
+
+func setRandomDelay(minutes int) error {
+	if minutes < 0 {
+		return errors.New("random delay can not be negative")
+	}
+	return updateSaltConfig(map[string]interface{}{"random-delay-minutes": minutes})
+}
+
+func getRandomDelay() (int, error) {
+	saltSetup, err := readSaltConfig()
+	if err != nil {
+		return 0, err
+	}
+	return saltSetup.RandomDelayMinutes, nil
+}
+
+func setPinnedRef(ref string) error {
+	return updateSaltConfig(map[string]interface{}{"pinned-ref": strings.TrimSpace(ref)})
+}
+
+func getPinnedRef() (string, error) {
+	saltSetup, err := readSaltConfig()
+	if err != nil {
+		return "", err
+	}
+	return saltSetup.PinnedRef, nil
+}
+
+// updateOutputArgs returns the salt-call output arguments for an update.
+func updateOutputArgs() []string {
+	saltSetup := loadSaltConfig()
+	switch saltSetup.OutputFormat {
+	case "json":
+		return []string{"--out=json"}
+	case "text", "":
+	default:
+		log.Errorf("Invalid output format '%s', using 'text'", saltSetup.OutputFormat)
+	}
+	stateOutput := saltSetup.StateOutput
+	if !slices.Contains(validStateOutputs, stateOutput) {
+		log.Errorf("Invalid state output '%s', using 'mixed'", stateOutput)
+		stateOutput = "mixed"
+	}
+	args := []string{"--state-output=" + stateOutput}
+	if saltSetup.OutputDiff {
+		args = append(args, "--output-diff")
+	}
+	return args
+}
+
+var validSaltLogLevels = []string{"all", "garbage", "trace", "debug", "profile", "info", "warning", "error", "critical", "quiet"}
+
+// validateSaltCallArg checks that a global salt-call arg is allowed. Only flags that change the
+// logging of salt-call or turn colour off are allowed so a config can't change what salt applies
+// or the output that is parsed.
+func validateSaltCallArg(arg string) error {
+	flag, value, hasValue := strings.Cut(arg, "=")
+	switch flag {
+	case "--log-level", "--log-file-level":
+		if !hasValue || !slices.Contains(validSaltLogLevels, value) {
+			return fmt.Errorf("invalid log level in salt-call arg '%s', valid levels are %v", arg, validSaltLogLevels)
+		}
+		return nil
+	case "--no-color":
+		if hasValue {
+			return fmt.Errorf("salt-call arg '%s' does not take a value", arg)
+		}
+		return nil
+	}
+	return fmt.Errorf("salt-call arg '%s' is not allowed", arg)
+}
+
+// saltCallGlobalArgs returns the global salt-call args from the config for a salt call with the
+// args, skipping any that are not allowed. In masterless mode "--local" is added if the call
+// doesn't already have it.
+func (c *saltConfig) saltCallGlobalArgs(callArgs []string) []string {
+	args := []string{}
+	if c.Masterless && !slices.Contains(callArgs, "--local") {
+		args = append(args, "--local")
+	}
+	for _, arg := range c.SaltCallArgs {
+		if err := validateSaltCallArg(arg); err != nil {
+			log.Errorf("Ignoring salt-call arg: %v", err)
+			continue
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// saltBranch returns the saltops branch for the nodegroup, this is the branch override
+// if there is one, otherwise the nodegroup's branch on the configured channel.
+func (c *saltConfig) saltBranch(nodegroup string) (string, error) {
+	if c.BranchOverride != "" {
+		return c.BranchOverride, nil
+	}
+	return saltrequester.ResolveBranch(nodegroup, c.Channel)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// saltopsCompareURL is the GitHub page comparing two saltops commits.
+const saltopsCompareURL = "https://github.com/TheCacophonyProject/saltops/compare/%s...%s"
+
+// latestUpdateInfo gets the latest saltops version for the pinned ref or, if not pinned, the
+// branch the device follows. A branch override missing from the version info is read as a ref.
+func latestUpdateInfo(saltSetup *saltConfig) (*saltrequester.UpdateInfo, error) {
+	if saltSetup.PinnedRef != "" {
+		return saltrequester.GetRefUpdateInfo(saltSetup.PinnedRef)
+	}
+	nodegroup, err := saltrequester.ReadNodegroup()
+	if err != nil && saltSetup.BranchOverride == "" {
+		return nil, err
+	}
+	branch, err := saltSetup.saltBranch(nodegroup)
+	if err != nil {
+		return nil, err
+	}
+	info, err := saltrequester.GetBranchUpdateInfo(branch)
+	if errors.Is(err, saltrequester.ErrBranchNotFound) && saltSetup.BranchOverride != "" {
+		return saltrequester.GetRefUpdateInfo(branch)
+	}
+	return info, err
+}
+
+// diffCommand prints the saltops commit installed by the last update and the latest available commit.
+func diffCommand(showURL bool) error {
+	state, err := saltrequester.State()
+	if err != nil {
+		return fmt.Errorf("failed to get salt state, %v", err)
+	}
+	latest, err := latestUpdateInfo(loadSaltConfig())
+	if err != nil {
+		return fmt.Errorf("failed to get the latest saltops version, %v", err)
+	}
+	fmt.Print(formatDiff(state, latest, showURL))
+	return nil
+}
+
+// formatDiff describes the difference between the installed and latest saltops commits.
+func formatDiff(state *saltrequester.SaltState, latest *saltrequester.UpdateInfo, showURL bool) string {
+	var b strings.Builder
+	installed := state.LastUpdateSHA
+	if installed == "" {
+		installed = "unknown, no commit recorded by an update yet"
+	}
+	fmt.Fprintf(&b, "Installed commit: %s\n", installed)
+	if state.LastUpdateVersion != "" {
+		fmt.Fprintf(&b, "Installed version: %s\n", state.LastUpdateVersion)
+	}
+
+	available := latest.CommitSHA
+	if available == "" {
+		available = "unknown, not in the version info"
+	}
+	if latest.Branch != "" {
+		fmt.Fprintf(&b, "Latest commit on %s: %s\n", latest.Branch, available)
+	} else {
+		fmt.Fprintf(&b, "Latest commit: %s\n", available)
+	}
+	if latest.Version != "" {
+		fmt.Fprintf(&b, "Latest version: %s\n", latest.Version)
+	}
+
+	switch {
+	case state.LastUpdateSHA == "" || latest.CommitSHA == "":
+		fmt.Fprintln(&b, "Can't compare the commits without both SHAs.")
+	case state.LastUpdateSHA == latest.CommitSHA:
+		fmt.Fprintln(&b, "Up to date.")
+	case showURL:
+		fmt.Fprintf(&b, "Compare: %s\n", fmt.Sprintf(saltopsCompareURL, state.LastUpdateSHA, latest.CommitSHA))
+	}
+	return b.String()
+}
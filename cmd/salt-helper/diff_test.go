@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatDiff(t *testing.T) {
+	latest := &saltrequester.UpdateInfo{Branch: "prod", Version: "v1.3.0", CommitSHA: "def456"}
+
+	out := formatDiff(&saltrequester.SaltState{LastUpdateSHA: "abc123", LastUpdateVersion: "v1.2.3"}, latest, true)
+	assert.Contains(t, out, "Installed commit: abc123\n")
+	assert.Contains(t, out, "Latest commit on prod: def456\n")
+	assert.Contains(t, out, "Compare: https://github.com/TheCacophonyProject/saltops/compare/abc123...def456\n")
+
+	out = formatDiff(&saltrequester.SaltState{LastUpdateSHA: "abc123"}, latest, false)
+	assert.NotContains(t, out, "Compare:")
+
+	out = formatDiff(&saltrequester.SaltState{LastUpdateSHA: "def456"}, latest, true)
+	assert.Contains(t, out, "Up to date.")
+	assert.NotContains(t, out, "Compare:")
+
+	out = formatDiff(&saltrequester.SaltState{}, latest, true)
+	assert.Contains(t, out, "no commit recorded")
+	assert.NotContains(t, out, "Compare:")
+}
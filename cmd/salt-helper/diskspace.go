@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+// lowDiskSpaceError is returned when a path has less free space than is needed for an update.
+type lowDiskSpaceError struct {
+	path      string
+	freeMB    uint64
+	minFreeMB uint64
+}
+
+func (e *lowDiskSpaceError) Error() string {
+	return fmt.Sprintf("not enough free disk space on %s for an update, %d MB free and %d MB needed", e.path, e.freeMB, e.minFreeMB)
+}
+
+// freeDiskSpaceMB returns the free space, available to non root users, of the filesystem the path is on.
+func freeDiskSpaceMB(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize) / (1024 * 1024), nil
+}
+
+// checkDiskSpace checks that each path has at least minFreeMB of free space. A path that can't be
+// checked, e.g. because it doesn't exist yet, is skipped.
+func checkDiskSpace(paths []string, minFreeMB int) error {
+	if minFreeMB <= 0 {
+		return nil
+	}
+	for _, path := range paths {
+		freeMB, err := freeDiskSpaceMB(path)
+		if err != nil {
+			log.Errorf("Failed to check free disk space on %s: %v", path, err)
+			continue
+		}
+		log.Debugf("%d MB free on %s", freeMB, path)
+		if freeMB < uint64(minFreeMB) {
+			return &lowDiskSpaceError{path: path, freeMB: freeMB, minFreeMB: uint64(minFreeMB)}
+		}
+	}
+	return nil
+}
+
+func makeLowDiskSpaceEvent(err *lowDiskSpaceError, nodegroup string) eventclient.Event {
+	return eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      eventType("salt-update-low-disk-space"),
+		Details: map[string]interface{}{
+			"path":      err.path,
+			"freeMB":    err.freeMB,
+			"minFreeMB": err.minFreeMB,
+			"nodegroup": nodegroup,
+			"minionID":  minionID,
+		},
+	}
+}
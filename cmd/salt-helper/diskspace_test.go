@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	log = logging.NewLogger("info")
+	dir := t.TempDir()
+	assert.NoError(t, checkDiskSpace([]string{dir}, 0))
+	assert.NoError(t, checkDiskSpace([]string{dir}, 1))
+
+	// A path that doesn't exist is skipped.
+	assert.NoError(t, checkDiskSpace([]string{filepath.Join(dir, "missing")}, 1<<30))
+
+	err := checkDiskSpace([]string{dir}, 1<<30)
+	var lowDiskErr *lowDiskSpaceError
+	assert.True(t, errors.As(err, &lowDiskErr))
+	assert.Equal(t, dir, lowDiskErr.path)
+
+	event := makeLowDiskSpaceEvent(lowDiskErr, "tc2-prod")
+	assert.Equal(t, "salt-update-low-disk-space", event.Type)
+	assert.Equal(t, uint64(1<<30), event.Details["minFreeMB"])
+}
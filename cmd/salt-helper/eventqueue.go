@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// eventQueueFile is where salt-update events that failed to send are saved until they are
+// sent again, a var so tests can change it.
+var eventQueueFile = "/etc/cacophony/salt-helper-event-queue.json"
+
+// maxQueuedEvents limits how many events are kept in the queue, the oldest are dropped first.
+const maxQueuedEvents = 50
+
+// eventQueueMu stops the event queue file being changed by two goroutines at once.
+var eventQueueMu sync.Mutex
+
+// readEventQueue reads the queued events, oldest first. The queue is empty if the file doesn't exist.
+func readEventQueue() ([]eventclient.Event, error) {
+	events := []eventclient.Event{}
+	data, err := os.ReadFile(eventQueueFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func writeEventQueue(events []eventclient.Event) error {
+	if len(events) == 0 {
+		err := os.Remove(eventQueueFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return saltrequester.WriteFileAtomic(eventQueueFile, data)
+}
+
+// queueEvent adds the event to the queue, returning how many events are queued.
+func queueEvent(event eventclient.Event) (int, error) {
+	eventQueueMu.Lock()
+	defer eventQueueMu.Unlock()
+	events, err := readEventQueue()
+	if err != nil {
+		// Start a new queue rather than never queueing events again.
+		log.Errorf("Failed to read event queue, starting a new queue: %v", err)
+		events = []eventclient.Event{}
+	}
+	events = append(events, event)
+	if len(events) > maxQueuedEvents {
+		log.Printf("Event queue is full, dropping %d oldest events", len(events)-maxQueuedEvents)
+		events = events[len(events)-maxQueuedEvents:]
+	}
+	return len(events), writeEventQueue(events)
+}
+
+// sendQueuedEvents tries to send the queued events, oldest first, returning how many are still queued.
+// It stops at the first event that fails to send as the rest will most likely fail too.
+func sendQueuedEvents() (int, error) {
+	eventQueueMu.Lock()
+	defer eventQueueMu.Unlock()
+	events, err := readEventQueue()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, event := range events {
+		if err := addEvent(event); err != nil {
+			log.Printf("Failed to send queued %s event: %v", event.Type, err)
+			break
+		}
+		sent++
+	}
+	if sent == 0 {
+		return len(events), nil
+	}
+	log.Printf("Sent %d queued events", sent)
+	remaining := events[sent:]
+	return len(remaining), writeEventQueue(remaining)
+}
+
+// addEventOrQueue sends the event, queueing it to be sent later if it fails, e.g. when the
+// event-reporter isn't running.
+func (s *saltUpdater) addEventOrQueue(event eventclient.Event) {
+	err := addEvent(event)
+	if err == nil {
+		return
+	}
+	log.Errorf("Failed to add %s event, queueing it to send later: %v", event.Type, err)
+	pending, err := queueEvent(event)
+	if err != nil {
+		log.Errorf("Failed to queue %s event: %v", event.Type, err)
+		return
+	}
+	s.state.PendingEvents = pending
+	s.stateChanged()
+}
+
+// retryQueuedEvents sends the events that failed to send before.
+func (s *saltUpdater) retryQueuedEvents() {
+	pending, err := sendQueuedEvents()
+	if err != nil {
+		log.Errorf("Failed to send queued events: %v", err)
+		return
+	}
+	if pending != s.state.PendingEvents {
+		s.state.PendingEvents = pending
+		s.stateChanged()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventQueue(t *testing.T) {
+	salt, events := newTestSaltUpdater(t, &fakeSaltRunner{out: testOutSuccess})
+	sendErr := errors.New("event-reporter is not running")
+	addEvent = func(event eventclient.Event) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		*events = append(*events, event)
+		return nil
+	}
+
+	_, err := salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, *events)
+	assert.Equal(t, 1, salt.state.PendingEvents)
+
+	// Still offline, the event stays queued.
+	salt.retryQueuedEvents()
+	assert.Equal(t, 1, salt.state.PendingEvents)
+
+	sendErr = nil
+	salt.retryQueuedEvents()
+	assert.Equal(t, 0, salt.state.PendingEvents)
+	assert.Len(t, *events, 1)
+	assert.Equal(t, "salt-update", (*events)[0].Type)
+	assert.Equal(t, true, (*events)[0].Details["success"])
+
+	queued, err := readEventQueue()
+	assert.NoError(t, err)
+	assert.Empty(t, queued)
+}
+
+func TestEventQueueDropsOldest(t *testing.T) {
+	newTestSaltUpdater(t, &fakeSaltRunner{})
+	for i := 0; i < maxQueuedEvents+5; i++ {
+		pending, err := queueEvent(eventclient.Event{Type: fmt.Sprintf("event-%d", i)})
+		assert.NoError(t, err)
+		assert.Equal(t, min(i+1, maxQueuedEvents), pending)
+	}
+
+	queued, err := readEventQueue()
+	assert.NoError(t, err)
+	assert.Len(t, queued, maxQueuedEvents)
+	assert.Equal(t, "event-5", queued[0].Type)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+const followPollInterval = time.Second
+
+// applyUpdate calls for a salt update. If follow is set the progress is printed until the
+// update finishes, returning an error if the update failed.
+func applyUpdate(force, follow bool) error {
+	running, err := saltrequester.IsRunning()
+	if err != nil {
+		return fmt.Errorf("failed to check if a salt update is running: %v", err)
+	}
+	if running {
+		return errors.New("a salt update is already running")
+	}
+
+	var jobID string
+	if force {
+		log.Println("Forcing a salt update.")
+		jobID, err = saltrequester.ForceUpdateJob()
+	} else {
+		log.Println("Calling for a salt update.")
+		jobID, err = saltrequester.RunUpdateJob()
+	}
+	if err != nil || !follow {
+		return err
+	}
+	return followUpdate(jobID)
+}
+
+// followUpdate prints the progress of the update job until it finishes.
+func followUpdate(jobID string) error {
+	lastProgress := ""
+	for {
+		job, err := saltrequester.JobStatus(jobID)
+		if err != nil {
+			return fmt.Errorf("failed to get update job status, %v", err)
+		}
+
+		if job.State == saltrequester.JobRunning {
+			progress := fmt.Sprintf("%3d%% %s", job.ProgressPercentage, job.Result)
+			if progress != lastProgress {
+				fmt.Println(progress)
+				lastProgress = progress
+			}
+		}
+
+		switch job.State {
+		case saltrequester.JobSucceeded:
+			fmt.Println("Salt update finished successfully")
+			return nil
+		case saltrequester.JobFailed:
+			return fmt.Errorf("salt update failed: %s", job.Result)
+		case saltrequester.JobSkipped:
+			fmt.Printf("Salt update did not run: %s\n", job.Result)
+			return nil
+		}
+		time.Sleep(followPollInterval)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+const healthCheckTimeout = 30 * time.Second
+
+// healthCheck gets the salt and python versions from the minion and checks if the salt master is reachable.
+func healthCheck() (*saltrequester.HealthReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "salt-call", "--local", "test.versions_report").CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("salt versions report timed out after %s", healthCheckTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get salt versions report: %v, %s", err, string(out))
+	}
+	report := parseVersionsReport(string(out))
+
+	// There is no salt master to reach in masterless mode.
+	if loadSaltConfig().Masterless {
+		return report, nil
+	}
+	reachable, latency, err := checkMasterReachable()
+	if err != nil {
+		log.Errorf("Failed to check if salt master is reachable: %v", err)
+	}
+	report.MasterReachable = reachable
+	report.MasterLatency = latency
+	return report, nil
+}
+
+// parseVersionsReport parses the salt and python versions from the output of test.versions_report.
+func parseVersionsReport(out string) *saltrequester.HealthReport {
+	report := &saltrequester.HealthReport{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Salt":
+			report.SaltVersion = strings.TrimSpace(value)
+		case "Python":
+			report.PythonVersion = strings.TrimSpace(value)
+		}
+	}
+	return report
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testVersionsReport = `local:
+    Salt Version:
+              Salt: 3006.1
+
+    Python Version:
+            Python: 3.10.11 (main, May  5 2023, 02:31:54) [GCC 11.2.0]
+
+    Dependency Versions:
+              cffi: 1.14.6
+          M2Crypto: Not Installed
+              Jinja2: 3.1.2
+`
+
+func TestParseVersionsReport(t *testing.T) {
+	report := parseVersionsReport(testVersionsReport)
+	assert.Equal(t, "3006.1", report.SaltVersion)
+	assert.Equal(t, "3.10.11 (main, May  5 2023, 02:31:54) [GCC 11.2.0]", report.PythonVersion)
+}
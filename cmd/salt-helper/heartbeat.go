@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// heartbeatInterval is the longest the run-dbus loop goes without a heartbeat.
+// A systemd WatchdogSec for the service should be longer than this.
+const heartbeatInterval = time.Minute
+
+// heartbeatFailed is set once a heartbeat error has been logged, so it is only logged once.
+var heartbeatFailed = false
+
+// heartbeat shows the run-dbus loop is still running. The time is written to the heartbeat file,
+// and if running under systemd with a watchdog the watchdog is notified.
+func heartbeat() {
+	err := os.WriteFile(loadSaltConfig().HeartbeatFile, []byte(time.Now().Format(time.RFC3339)), 0644)
+	if err == nil {
+		err = sdNotify("WATCHDOG=1")
+	}
+	if err != nil && !heartbeatFailed {
+		log.Errorf("Failed to write heartbeat: %v", err)
+		heartbeatFailed = true
+	}
+}
+
+// sleepWithHeartbeat sleeps for the duration, sending a heartbeat at least every heartbeatInterval.
+func sleepWithHeartbeat(d time.Duration) {
+	sleepWithHeartbeatOrCancel(d, nil)
+}
+
+// sleepWithHeartbeatOrCancel sleeps like sleepWithHeartbeat but returns early when cancel receives,
+// returning false if the sleep was cut short.
+func sleepWithHeartbeatOrCancel(d time.Duration, cancel <-chan struct{}) bool {
+	end := time.Now().Add(d)
+	for {
+		heartbeat()
+		remaining := time.Until(end)
+		if remaining <= 0 {
+			return true
+		}
+		timer := time.NewTimer(min(remaining, heartbeatInterval))
+		select {
+		case <-timer.C:
+		case <-cancel:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// sdNotify sends a notification to systemd, doing nothing if not run by systemd with NOTIFY_SOCKET set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
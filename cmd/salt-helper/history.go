@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// historyFile is where the update history is saved, a var so tests can change it.
+var historyFile = "/etc/cacophony/salt-update-history.json"
+
+// maxHistoryRecords limits how many updates are kept in the history, the oldest are removed first.
+const maxHistoryRecords = 200
+
+// historyMu stops the history file being changed by two updates at once.
+var historyMu sync.Mutex
+
+// makeUpdateRecord makes the history record for the update in the salt state.
+func makeUpdateRecord(state saltrequester.SaltState) saltrequester.UpdateRecord {
+	// The saved summary is used as the output can be truncated.
+	var failed int
+	if state.LastCallSummary != nil {
+		failed = state.LastCallSummary.Failed
+	} else {
+		jsonSummary, _ := parseSaltJSON(state.LastCallOut)
+		failed, _ = parseFailedCount(state.LastCallOut, jsonSummary)
+	}
+	return saltrequester.UpdateRecord{
+		Time:           state.LastAttempt,
+		Trigger:        state.LastTrigger,
+		JobID:          state.JobID,
+		Success:        state.LastCallSuccess,
+		Nodegroup:      state.LastCallNodegroup,
+		Branch:         state.LastCallBranch,
+		Version:        state.AvailableVersion,
+		SHA:            state.AvailableSHA,
+		RunTimeSeconds: state.LastRunTimeSeconds,
+		FailedStates:   failed,
+		RebootPending:  state.RebootPending,
+	}
+}
+
+// readHistory reads the update history, oldest first. There is no history if the file doesn't exist.
+func readHistory() ([]saltrequester.UpdateRecord, error) {
+	records := []saltrequester.UpdateRecord{}
+	data, err := os.ReadFile(historyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// addHistory adds the record to the update history.
+func addHistory(record saltrequester.UpdateRecord) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	records, err := readHistory()
+	if err != nil {
+		// Start a new history rather than never recording updates again.
+		log.Errorf("Failed to read update history, starting a new history: %v", err)
+		records = []saltrequester.UpdateRecord{}
+	}
+	records = append(records, record)
+	if len(records) > maxHistoryRecords {
+		records = records[len(records)-maxHistoryRecords:]
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return saltrequester.WriteFileAtomic(historyFile, data)
+}
+
+// historySince returns the update records that started after the time.
+func historySince(since time.Time) ([]saltrequester.UpdateRecord, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	records, err := readHistory()
+	if err != nil {
+		return nil, err
+	}
+	newRecords := []saltrequester.UpdateRecord{}
+	for _, record := range records {
+		if record.Time.After(since) {
+			newRecords = append(newRecords, record)
+		}
+	}
+	return newRecords, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistorySince(t *testing.T) {
+	newTestSaltUpdater(t, &fakeSaltRunner{})
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	records, err := historySince(time.Time{})
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, addHistory(saltrequester.UpdateRecord{
+			Time:    start.Add(time.Duration(i) * 24 * time.Hour),
+			Trigger: saltrequester.TriggerScheduled,
+			Success: i != 1,
+		}))
+	}
+
+	records, err = historySince(time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+
+	records, err = historySince(start)
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.True(t, start.Add(24*time.Hour).Equal(records[0].Time))
+	assert.False(t, records[0].Success)
+}
+
+func TestAddHistoryLimit(t *testing.T) {
+	newTestSaltUpdater(t, &fakeSaltRunner{})
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < maxHistoryRecords+5; i++ {
+		assert.NoError(t, addHistory(saltrequester.UpdateRecord{Time: start.Add(time.Duration(i) * time.Hour)}))
+	}
+	records, err := readHistory()
+	assert.NoError(t, err)
+	assert.Len(t, records, maxHistoryRecords)
+	assert.True(t, start.Add(5*time.Hour).Equal(records[0].Time))
+}
+
+func TestAddHistoryCorruptFile(t *testing.T) {
+	newTestSaltUpdater(t, &fakeSaltRunner{})
+	assert.NoError(t, os.WriteFile(historyFile, []byte("[{\"Time\":"), 0644))
+	assert.NoError(t, addHistory(saltrequester.UpdateRecord{Success: true}))
+	records, err := readHistory()
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(historyFile), "salt-update-history.json.tmp"))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+const (
+	updateHooksDir    = "/etc/cacophony/salt-update-hooks.d"
+	updateHookTimeout = 5 * time.Minute
+)
+
+// runUpdateHooks runs the executables in the update hooks directory, in name order, after a salt update.
+// The nodegroup and if the update was successful are passed with the SALT_NODEGROUP and
+// SALT_UPDATE_SUCCESS environment variables. Hook failures are logged but don't fail the update.
+func runUpdateHooks(state saltrequester.SaltState) {
+	entries, err := os.ReadDir(updateHooksDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to read update hooks directory: %v", err)
+		return
+	}
+
+	env := append(os.Environ(),
+		"SALT_NODEGROUP="+state.LastCallNodegroup,
+		"SALT_UPDATE_SUCCESS="+strconv.FormatBool(state.LastCallSuccess),
+	)
+	for _, entry := range entries {
+		hook := filepath.Join(updateHooksDir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			log.Errorf("Failed to read update hook '%s': %v", hook, err)
+			continue
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			log.Debugf("Skipping '%s' as it is not an executable file", hook)
+			continue
+		}
+		if err := runUpdateHook(hook, env); err != nil {
+			log.Errorf("Update hook '%s' failed: %v", hook, err)
+		}
+	}
+}
+
+func runUpdateHook(hook string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), updateHookTimeout)
+	defer cancel()
+
+	log.Printf("Running update hook '%s'", hook)
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("Update hook '%s' output:\n%s", hook, string(out))
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", updateHookTimeout)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// maxJobs limits how many update jobs are kept, the oldest are removed first.
+const maxJobs = 50
+
+// updateJobs tracks the update jobs so the result of each update request can be found by its ID.
+type updateJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*saltrequester.UpdateJob
+	order []string
+}
+
+// add makes a pending job for an update request, returning its ID.
+func (j *updateJobs) add(trigger saltrequester.UpdateTrigger) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.jobs == nil {
+		j.jobs = map[string]*saltrequester.UpdateJob{}
+	}
+	id := newJobID()
+	j.jobs[id] = &saltrequester.UpdateJob{
+		ID:      id,
+		Trigger: trigger,
+		State:   saltrequester.JobPending,
+		Created: time.Now(),
+	}
+	j.order = append(j.order, id)
+	if len(j.order) > maxJobs {
+		delete(j.jobs, j.order[0])
+		j.order = j.order[1:]
+	}
+	return id
+}
+
+// start marks the job as running.
+func (j *updateJobs) start(id string) {
+	j.update(id, func(job *saltrequester.UpdateJob) {
+		job.State = saltrequester.JobRunning
+	})
+}
+
+// finish records the result of the job.
+func (j *updateJobs) finish(id string, state saltrequester.JobState, result string) {
+	j.update(id, func(job *saltrequester.UpdateJob) {
+		job.State = state
+		job.Result = result
+		job.Finished = time.Now()
+		if state == saltrequester.JobSucceeded {
+			job.ProgressPercentage = 100
+		}
+	})
+}
+
+func (j *updateJobs) update(id string, update func(*saltrequester.UpdateJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if job, ok := j.jobs[id]; ok {
+		update(job)
+	}
+}
+
+// get returns a copy of the job, or false if there is no job with the ID.
+func (j *updateJobs) get(id string) (saltrequester.UpdateJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return saltrequester.UpdateJob{}, false
+	}
+	return *job, true
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to the time, it is still unique enough for the few jobs kept.
+		return time.Now().Format("20060102T150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// jobStatus returns the job with the ID, the progress of a running job is from the salt state.
+func (s *saltUpdater) jobStatus(id string) (saltrequester.UpdateJob, bool) {
+	job, ok := s.jobs.get(id)
+	if ok && job.State == saltrequester.JobRunning && s.state.JobID == id {
+		job.ProgressPercentage = s.state.UpdateProgressPercentage
+		job.Result = s.state.UpdateProgressStr
+	}
+	return job, ok
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateJobs(t *testing.T) {
+	jobs := updateJobs{}
+	first := jobs.add(saltrequester.TriggerManual)
+	second := jobs.add(saltrequester.TriggerForce)
+	assert.NotEqual(t, first, second)
+
+	jobs.start(first)
+	jobs.finish(first, saltrequester.JobFailed, "Salt update failed")
+	job, ok := jobs.get(first)
+	assert.True(t, ok)
+	assert.Equal(t, saltrequester.JobFailed, job.State)
+	assert.Equal(t, "Salt update failed", job.Result)
+	assert.False(t, job.Finished.IsZero())
+
+	// The second job isn't changed by the first finishing.
+	job, ok = jobs.get(second)
+	assert.True(t, ok)
+	assert.Equal(t, saltrequester.JobPending, job.State)
+
+	for i := 0; i < maxJobs; i++ {
+		jobs.add(saltrequester.TriggerScheduled)
+	}
+	_, ok = jobs.get(first)
+	assert.False(t, ok)
+	assert.Len(t, jobs.jobs, maxJobs)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// saltCallLockFile is locked while salt-helper runs a salt call so that separate
+// processes don't run salt calls at the same time. A var so tests can change it.
+var saltCallLockFile = "/var/lock/salt-helper.lock"
+
+var errSaltCallLocked = errors.New("another process is running a salt call")
+
+// lockSaltCall takes the system wide salt call lock, returning errSaltCallLocked if
+// another process has it. The returned function releases the lock.
+func lockSaltCall() (func(), error) {
+	file, err := os.OpenFile(saltCallLockFile, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open salt call lock file: %v", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errSaltCallLocked
+		}
+		return nil, fmt.Errorf("failed to lock salt call lock file: %v", err)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
@@ -20,15 +20,23 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
@@ -38,6 +46,7 @@ import (
 	"github.com/TheCacophonyProject/modemd/modemlistener"
 	saltrequester "github.com/TheCacophonyProject/salt-updater"
 	arg "github.com/alexflint/go-arg"
+	"github.com/godbus/dbus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -46,25 +55,85 @@ var version = "<not set>"
 var log *logrus.Logger
 
 const configDir = goconfig.DefaultConfigDir
-const minionLogFile = "/var/log/salt/minion"
-const totalStatesCountFile = "/etc/cacophony/salt-states-count"
+
+// totalStatesCountFile has the number of states in the last successful update, a var so tests can change it.
+var totalStatesCountFile = "/etc/cacophony/salt-states-count"
+
+// maxAppliedStates limits how many state names from an update are kept in the salt state.
+const maxAppliedStates = 500
 
 // Args app arguments
 type Args struct {
-	RunDbus           *subcommand          `arg:"subcommand:run-dbus" help:"Run the dbus service."`
-	RunUpdate         *runUpdateSubcommand `arg:"subcommand:run-update" help:"Run a salt update if one is not already running."`
-	Ping              *subcommand          `arg:"subcommand:ping" help:"Don't run a salt state.apply, just ping the salt server. Will not delay call."`
-	State             *subcommand          `arg:"subcommand:state" help:"Print out the current state of the salt update"`
-	EnableAutoUpdate  *subcommand          `arg:"subcommand:enable-auto-update" help:"Enables update check on PI boot up"`
-	DisableAutoUpdate *subcommand          `arg:"subcommand:disable-auto-update" help:"Disables updates on PI boot"`
-	CheckForUpdate    *subcommand          `arg:"subcommand:check-for-update" help:"Checks if there is an update available"`
+	RunDbus           *runDbusSubcommand         `arg:"subcommand:run-dbus" help:"Run the dbus service."`
+	RunUpdate         *runUpdateSubcommand       `arg:"subcommand:run-update" help:"Run a salt update if one is not already running."`
+	Ping              *subcommand                `arg:"subcommand:ping" help:"Don't run a salt state.apply, just ping the salt server. Will not delay call."`
+	State             *stateSubcommand           `arg:"subcommand:state" help:"Print out the current state of the salt update"`
+	EnableAutoUpdate  *subcommand                `arg:"subcommand:enable-auto-update" help:"Enables update check on PI boot up"`
+	DisableAutoUpdate *subcommand                `arg:"subcommand:disable-auto-update" help:"Disables updates on PI boot"`
+	CheckForUpdate    *checkForUpdateSubcommand  `arg:"subcommand:check-for-update" help:"Checks if there is an update available"`
+	ResetState        *resetStateSubcommand      `arg:"subcommand:reset-state" help:"Clear a stuck running salt call from the salt state"`
+	RandomDelay       *randomDelaySubcommand     `arg:"subcommand:random-delay" help:"Print or set the maximum random delay before a scheduled update"`
+	SetLastUpdate     *setLastUpdateSubcommand   `arg:"subcommand:set-last-update" help:"Set the time of the last successful update"`
+	Apply             *applySubcommand           `arg:"subcommand:apply" help:"Run a salt update, optionally following its progress"`
+	ResendEvent       *subcommand                `arg:"subcommand:resend-event" help:"Send the salt-update event for the last update again, from the state file"`
+	PauseAutoUpdate   *pauseAutoUpdateSubcommand `arg:"subcommand:pause-auto-update" help:"Skip scheduled updates for a while"`
+	NextUpdate        *subcommand                `arg:"subcommand:next-update" help:"Print when the next scheduled update check is"`
+	ReloadConfig      *subcommand                `arg:"subcommand:reload-config" help:"Make the dbus service read the salt config again"`
+	Selftest          *subcommand                `arg:"subcommand:selftest" help:"Check the update code with sample salt output, without running salt"`
+	Diff              *diffSubcommand            `arg:"subcommand:diff" help:"Compare the installed saltops commit with the latest available commit"`
+	UpdateWindow      *updateWindowSubcommand    `arg:"subcommand:update-window" help:"Print or set the hours scheduled updates can run in"`
 	logging.LogArgs
 }
 
+type runDbusSubcommand struct {
+	NoDelay bool `arg:"--no-delay" help:"Don't wait a random delay before running scheduled updates."`
+}
+
+type pauseAutoUpdateSubcommand struct {
+	Duration time.Duration `arg:"positional,required" help:"How long to pause scheduled updates for, e.g. 4h. 0 resumes them."`
+}
+
+type applySubcommand struct {
+	Force  bool `arg:"--force" help:"Run the update even if it is already up to date."`
+	Follow bool `arg:"--follow" help:"Print the progress until the update finishes, exiting with an error if it failed."`
+}
+
 type runUpdateSubcommand struct {
 	Force bool `arg:"--force" help:"Force running an update even if it is already up to date."`
 }
 
+type checkForUpdateSubcommand struct {
+	JSON bool `arg:"--json" help:"Print the result as JSON."`
+}
+
+type stateSubcommand struct {
+	JSON bool `arg:"--json" help:"Print the salt state as JSON."`
+}
+
+type resetStateSubcommand struct {
+	ClearLastUpdate bool `arg:"--clear-last-update" help:"Also clear the last update time so the next update check will run an update."`
+}
+
+type randomDelaySubcommand struct {
+	Set  *int `arg:"--set" help:"Set the maximum random delay in minutes."`
+	Skip bool `arg:"--skip" help:"End the random delay of a waiting scheduled update so it runs now."`
+}
+
+type setLastUpdateSubcommand struct {
+	Time  string `arg:"positional,required" help:"Time of the last update in RFC3339 format, e.g. 2024-05-01T12:00:00Z."`
+	Force bool   `arg:"--force" help:"Allow setting a time in the future."`
+}
+
+type updateWindowSubcommand struct {
+	Start    *int   `arg:"--start" help:"Set the hour, 0-23, the update window starts."`
+	End      *int   `arg:"--end" help:"Set the hour, 0-23, the update window ends."`
+	Timezone string `arg:"--timezone" help:"Timezone of the update window hours, e.g. Pacific/Auckland. The local timezone if not set."`
+}
+
+type diffSubcommand struct {
+	URL bool `arg:"--url" help:"Also print the GitHub URL comparing the two commits."`
+}
+
 type subcommand struct{}
 
 // Version return version of app
@@ -79,11 +148,66 @@ func procArgs() Args {
 }
 
 type saltUpdater struct {
-	state *saltrequester.SaltState
+	state  *saltrequester.SaltState
+	runner SaltRunner
+	// unknownNodegroupErr is the last unknown nodegroup error logged, used so it is only logged once per nodegroup.
+	unknownNodegroupErr string
+	// minionLogMissingLogged is set once it has been logged that the minion log can't be opened.
+	minionLogMissingLogged bool
+	stateCache             stateCache
+	// minionInfo is the cached salt minion info, see saltInfo.
+	minionInfo   *saltrequester.MinionInfo
+	minionInfoMu sync.Mutex
+	// jobs are the update jobs, so the result of an update request can be found by its job ID.
+	jobs updateJobs
+	// skipDelay cuts short the random delay before a scheduled update, see skipRandomDelay.
+	// It has a buffer of 1.
+	skipDelay chan struct{}
+	// reloaded wakes the run-dbus loop when the config is reloaded, see wakeForReload.
+	// It has a buffer of 1.
+	reloaded chan struct{}
+	// inRandomDelay is set while the random delay before a scheduled update is running.
+	inRandomDelay atomic.Bool
+	// runningMu guards RunningUpdate and RunningArgs in the state, see claimSaltCall.
+	runningMu sync.Mutex
 }
 
 var minionID string
 
+// eventOutMaxBytes is the most of the salt call output that will be added to an event.
+var eventOutMaxBytes = defaultSaltConfig().EventOutMaxBytes
+
+// addEvent sends an event to the event-reporter, a var so tests can capture the events.
+var addEvent = eventclient.AddEvent
+
+// eventTypeSuffix is added to the type of every event, see eventType.
+var eventTypeSuffix = defaultSaltConfig().EventTypeSuffix
+
+// eventType returns the type for an event with the configured suffix added, e.g. "salt-update-prod".
+func eventType(base string) string {
+	return base + eventTypeSuffix
+}
+
+// repeatedFailureThreshold is the number of consecutive failed updates that sends a
+// salt-update-repeated-failure event, 0 to not send it.
+var repeatedFailureThreshold = defaultSaltConfig().RepeatedFailureThreshold
+
+// pingEvents sends an event with the result of each salt ping, salt-ping or salt-modem-ping after
+// the modem connects.
+var pingEvents = defaultSaltConfig().PingEvents
+
+// lastCallOutMaxBytes is the most of the salt call output that will be kept in the salt state.
+var lastCallOutMaxBytes = defaultSaltConfig().LastCallOutMaxBytes
+
+// stateFileOutMaxBytes is the most of the salt call output that will be saved in the state file.
+var stateFileOutMaxBytes = defaultSaltConfig().StateFileOutMaxBytes
+
+// modemPingRetries and modemPingRetryDelay are for retrying a failed salt ping after the modem connects.
+var (
+	modemPingRetries    = defaultSaltConfig().ModemPingRetries
+	modemPingRetryDelay = time.Duration(defaultSaltConfig().ModemPingRetryDelaySeconds) * time.Second
+)
+
 func main() {
 	if err := runMain(); err != nil {
 		log.Fatal(err)
@@ -98,9 +222,14 @@ func runMain() error {
 	log = logging.NewLogger(args.LogLevel)
 	log.Printf("Running version: %s", version)
 
+	// The self test doesn't need salt so is run before reading the minion ID.
+	if args.Selftest != nil {
+		return selftest()
+	}
+
 	// Read salt minion ID.
 	// Exit if failed to read salt minion ID as it means the device is not yet ready to run salt.
-	id, err := saltutil.GetMinionID(log)
+	id, err := readMinionIDWithRetry(minionIDTimeout)
 	if err != nil {
 		log.Error("Error reading minion ID: " + err.Error())
 		return err
@@ -113,16 +242,18 @@ func runMain() error {
 	if err != nil {
 		return err
 	}
-	var saltSetup = goconfig.DefaultSalt()
-	if err := config.Unmarshal(goconfig.SaltKey, &saltSetup); err != nil {
+	saltSetup, err := readSaltConfig()
+	if err != nil {
 		return err
 	}
-	log.Printf("Salt config: %+v", saltSetup)
+	log.Printf("Salt config: %+v", *saltSetup)
+	saltrequester.UserAgent = "cacophony-salt-updater/" + version
+	applySaltConfig(saltSetup)
 
 	// Run DBus service
 	if args.RunDbus != nil {
 		log.Info("Running dbus service")
-		_, err := runDbus()
+		salt, err := runDbus()
 		if err != nil {
 			return err
 		}
@@ -165,12 +296,9 @@ func runMain() error {
 		}
 
 		for {
-			// Check for update every 24 hours
-			err := saltrequester.RunUpdate()
-			if err != nil {
-				log.Error("Error running salt update: " + err.Error())
-			}
-			time.Sleep(24 * time.Hour)
+			// Check for update every update check interval, or sooner if the last update failed
+			salt.scheduledUpdate(args.RunDbus.NoDelay)
+			salt.waitForNextScheduledUpdate(time.Now())
 		}
 	}
 
@@ -186,6 +314,14 @@ func runMain() error {
 		if err != nil {
 			return fmt.Errorf("failed to get salt state, %v", err)
 		}
+		if args.State.JSON {
+			stateJSON, err := json.MarshalIndent(state, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(stateJSON))
+			return nil
+		}
 		log.Printf("salt state:\n%+v\n", *state)
 		return nil
 	}
@@ -218,55 +354,166 @@ func runMain() error {
 
 	// Run salt update
 	if args.RunUpdate != nil {
-		var err error
+		running, err := saltrequester.IsRunning()
+		if err != nil {
+			log.Errorf("Failed to check if a salt update is running: %v", err)
+		}
+		if running {
+			log.Println("A salt update is already running, not calling for another.")
+			return nil
+		}
+		var jobID string
 		if args.RunUpdate.Force {
 			log.Println("Forcing a salt update.")
-			err = saltrequester.ForceUpdate()
+			jobID, err = saltrequester.ForceUpdateJob()
 		} else {
 			log.Println("Calling for a salt update.")
-			err = saltrequester.RunUpdate()
+			jobID, err = saltrequester.RunUpdateJob()
 		}
 		if err != nil {
 			log.Println("Error calling for a salt update.")
 			return err
 		}
+		log.Printf("Update job: %s", jobID)
 		return nil
 	}
 
-	if args.CheckForUpdate != nil {
-		// Check for the nodegroup changing
-		nodegroupChange, err := checkNodeGroupChange()
+	if args.PauseAutoUpdate != nil {
+		if err := saltrequester.PauseAutoUpdate(args.PauseAutoUpdate.Duration); err != nil {
+			log.Errorf("Failed to pause auto update: %v", err)
+			return err
+		}
+		if args.PauseAutoUpdate.Duration <= 0 {
+			log.Info("Auto update has been resumed")
+		} else {
+			log.Printf("Auto update has been paused for %s", args.PauseAutoUpdate.Duration)
+		}
+		return nil
+	}
+
+	if args.ReloadConfig != nil {
+		if err := saltrequester.ReloadConfig(); err != nil {
+			log.Errorf("Failed to reload config: %v", err)
+			return err
+		}
+		log.Println("Salt config reloaded")
+		return nil
+	}
+
+	if args.NextUpdate != nil {
+		next, err := saltrequester.NextUpdate()
 		if err != nil {
-			log.Error(err)
+			log.Errorf("Failed to get the next update time: %v", err)
 			return err
 		}
-		if nodegroupChange {
-			log.Info("Found nodegroup change, recommend a salt update.")
+		if next.IsZero() {
+			log.Println("No scheduled update, auto update is off or paused, or an update check is running")
 			return nil
 		}
+		log.Printf("Next update check is at %s, in %s", next.Format(time.RFC3339), time.Until(next).Round(time.Second))
+		return nil
+	}
 
-		// Log last time a update was run.
-		state, err := saltrequester.State()
-		nodegroup := state.LastCallNodegroup
+	if args.UpdateWindow != nil {
+		if args.UpdateWindow.Start != nil || args.UpdateWindow.End != nil {
+			if args.UpdateWindow.Start == nil || args.UpdateWindow.End == nil {
+				return errors.New("both --start and --end are needed to set the update window")
+			}
+			start, end, timezone := *args.UpdateWindow.Start, *args.UpdateWindow.End, args.UpdateWindow.Timezone
+			if err := saltrequester.SetUpdateWindow(start, end, timezone); err != nil {
+				log.Errorf("Failed to set update window: %v", err)
+				return err
+			}
+			log.Printf("Update window set to %02d:00-%02d:00 %s", start, end, timezone)
+			return nil
+		}
+		start, end, timezone, err := saltrequester.GetUpdateWindow()
 		if err != nil {
-			return fmt.Errorf("failed to get salt state, %v", err)
+			log.Errorf("Failed to get update window: %v", err)
+			return err
 		}
-		log.Printf("Last update was run at '%s', with nodegroup '%s'", state.LastUpdate.Format("2006-01-02 15:04:05"), nodegroup)
+		if start == end {
+			log.Println("No update window is set, scheduled updates can run at any time")
+			return nil
+		}
+		log.Printf("Update window is %02d:00-%02d:00 %s", start, end, timezone)
+		return nil
+	}
+
+	if args.Diff != nil {
+		return diffCommand(args.Diff.URL)
+	}
+
+	if args.ResendEvent != nil {
+		return resendEvent()
+	}
 
-		// Log when the latest software was released.
-		latestUpdateTime, err := saltrequester.GetLatestUpdateTime(nodegroup)
+	if args.Apply != nil {
+		return applyUpdate(args.Apply.Force, args.Apply.Follow)
+	}
+
+	if args.RandomDelay != nil {
+		if args.RandomDelay.Skip {
+			skipped, err := saltrequester.SkipRandomDelay()
+			if err != nil {
+				log.Errorf("Failed to skip random delay: %v", err)
+				return err
+			}
+			if skipped {
+				log.Println("Random delay skipped, the scheduled update will run now")
+			} else {
+				log.Println("No scheduled update is waiting on a random delay")
+			}
+			return nil
+		}
+		if args.RandomDelay.Set != nil {
+			if err := saltrequester.SetRandomDelay(*args.RandomDelay.Set); err != nil {
+				log.Errorf("Failed to set random delay: %v", err)
+				return err
+			}
+			log.Printf("Random delay set to %d minutes", *args.RandomDelay.Set)
+			return nil
+		}
+		minutes, err := saltrequester.GetRandomDelay()
 		if err != nil {
-			log.Errorf("Error getting latest update time: %v", err)
+			log.Errorf("Failed to get random delay: %v", err)
 			return err
 		}
-		log.Printf("Latest software update was published at '%s', for nodegroup '%s'", latestUpdateTime.Format("2006-01-02 15:04:05"), nodegroup)
-		if state.LastUpdate.Before(latestUpdateTime) {
-			log.Info("Found new update, recommend a salt update.")
-			return nil
-		} else {
-			log.Info("No new update found, nothing to do.")
+		log.Printf("Random delay is %d minutes", minutes)
+		return nil
+	}
+
+	if args.SetLastUpdate != nil {
+		if err := saltrequester.SetLastUpdate(args.SetLastUpdate.Time, args.SetLastUpdate.Force); err != nil {
+			log.Errorf("Failed to set last update time: %v", err)
+			return err
+		}
+		log.Printf("Last update time set to %s", args.SetLastUpdate.Time)
+		return nil
+	}
+
+	if args.ResetState != nil {
+		log.Println("Resetting salt state.")
+		if err := saltrequester.ResetState(!args.ResetState.ClearLastUpdate); err != nil {
+			log.Errorf("Failed to reset salt state: %v", err)
+			return err
 		}
+		log.Println("Salt state has been reset.")
+		return nil
+	}
 
+	if args.CheckForUpdate != nil {
+		result, err := checkForUpdateCommand()
+		if err != nil {
+			return err
+		}
+		if args.CheckForUpdate.JSON {
+			resultJSON, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(resultJSON))
+		}
 		return nil
 	}
 
@@ -274,6 +521,158 @@ func runMain() error {
 	return errors.New("no command specified")
 }
 
+// scheduledUpdate runs the scheduled update from the run-dbus loop, waiting for it to finish.
+// A panic is recovered and logged so the loop keeps running.
+func (s *saltUpdater) scheduledUpdate(noDelay bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic in scheduled update: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	heartbeat()
+	// Nothing is scheduled while the update check runs.
+	s.setNextScheduledUpdate(time.Time{})
+	s.retryQueuedEvents()
+	// The config is read each time so changes, e.g. from SetAutoUpdate, apply without a restart.
+	saltSetup := loadSaltConfig()
+	applySaltConfig(saltSetup)
+	if !saltSetup.AutoUpdate {
+		log.Println("Auto update is off, skipping scheduled update")
+		return
+	}
+	if waitForUpdateWindow(saltSetup) {
+		// The config can change while waiting for the window, e.g. auto update turned off.
+		saltSetup = loadSaltConfig()
+		applySaltConfig(saltSetup)
+		if !saltSetup.AutoUpdate {
+			log.Println("Auto update was turned off while waiting for the update window, skipping scheduled update")
+			return
+		}
+	}
+	if noDelay {
+		log.Info("Random delay disabled, running update immediately")
+	} else {
+		s.randomDelay(maxRandomDelay(saltSetup, time.Now()))
+	}
+	if s.autoUpdatePaused() {
+		log.Printf("Auto update is paused until %s, skipping update", s.state.AutoUpdatePausedUntil.Format(time.RFC3339))
+	} else if s.shouldUpdateForNodegroupChange() {
+		s.updateForNodegroupChange()
+	} else {
+		s.runUpdateIfAvailable(saltrequester.TriggerScheduled)
+	}
+	s.waitForSaltCallToFinish()
+}
+
+const updateRetryInitial = 30 * time.Minute
+
+// updateCheckPeriod is the time between scheduled update checks, set from the update-check-interval-hours config.
+var updateCheckPeriod = time.Duration(defaultSaltConfig().UpdateCheckIntervalHours) * time.Hour
+
+// updateCheckInterval returns how long to wait before the next automatic update check.
+// After a failed update it retries sooner, backing off exponentially with each consecutive
+// failure up to the normal update check period.
+func updateCheckInterval(consecutiveFailures int) time.Duration {
+	if consecutiveFailures <= 0 {
+		return updateCheckPeriod
+	}
+	interval := updateRetryInitial
+	for i := 1; i < consecutiveFailures && interval < updateCheckPeriod; i++ {
+		interval *= 2
+	}
+	return min(interval, updateCheckPeriod)
+}
+
+// waitForNextScheduledUpdate sleeps until the next scheduled update check, measured from when the
+// last check started. A config reload, or auto update being changed over dbus, wakes it so a new
+// update check interval applies straight away and the next scheduled update is recorded again.
+func (s *saltUpdater) waitForNextScheduledUpdate(checked time.Time) {
+	for {
+		interval := updateCheckInterval(s.state.ConsecutiveFailures)
+		if s.state.ConsecutiveFailures > 0 {
+			log.Printf("%d consecutive update failures, retrying in %s", s.state.ConsecutiveFailures, interval)
+		}
+		next := checked.Add(interval)
+		s.setNextScheduledUpdate(s.nextScheduledUpdate(next))
+		if sleepWithHeartbeatOrCancel(time.Until(next), s.reloaded) {
+			return
+		}
+		log.Println("Config changed, rescheduling the next update check")
+	}
+}
+
+// nextScheduledUpdate returns when the next scheduled update can run if the run-dbus loop checks
+// for an update at next. The zero time is returned if auto update is off or will still be paused.
+func (s *saltUpdater) nextScheduledUpdate(next time.Time) time.Time {
+	if !loadSaltConfig().AutoUpdate {
+		return time.Time{}
+	}
+	if s.autoUpdatePaused() && s.state.AutoUpdatePausedUntil.After(next) {
+		return time.Time{}
+	}
+	return next
+}
+
+// wakeForReload wakes the run-dbus loop if it is waiting for the next scheduled update, so it
+// uses the reloaded config.
+func (s *saltUpdater) wakeForReload() {
+	// reloaded is buffered so the wake isn't lost while the loop is sending a heartbeat.
+	select {
+	case s.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+// waitForSaltCallToFinish waits until the salt state is no longer running a salt call.
+func (s *saltUpdater) waitForSaltCallToFinish() {
+	// Give a salt call started from dbus time to start.
+	time.Sleep(time.Second)
+	for s.isRunning() {
+		heartbeat()
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// randomDelay sleeps for a random duration up to maxDelay, see maxRandomDelay,
+// this spreads out the load on the salt master when many devices update at once.
+func (s *saltUpdater) randomDelay(maxDelay time.Duration) {
+	if maxDelay <= 0 {
+		return
+	}
+	delay := time.Duration(rand.Int63n(int64(maxDelay)))
+	log.Printf("Delaying salt update by %s", delay.Round(time.Second))
+	if !s.sleepRandomDelay(delay) {
+		log.Println("Random delay was cut short, running update now")
+	}
+}
+
+// sleepRandomDelay sleeps for the random delay, returning false if it was cut short by skipRandomDelay.
+func (s *saltUpdater) sleepRandomDelay(delay time.Duration) bool {
+	// Drop a skip left from before this delay started.
+	select {
+	case <-s.skipDelay:
+	default:
+	}
+	s.inRandomDelay.Store(true)
+	defer s.inRandomDelay.Store(false)
+	return sleepWithHeartbeatOrCancel(delay, s.skipDelay)
+}
+
+// skipRandomDelay ends the random delay before a scheduled update so the update runs now.
+// Returns false if the run-dbus loop isn't waiting on a random delay.
+func (s *saltUpdater) skipRandomDelay() bool {
+	if !s.inRandomDelay.Load() {
+		return false
+	}
+	// skipDelay is buffered so the skip isn't lost while the delay is sending a heartbeat.
+	select {
+	case s.skipDelay <- struct{}{}:
+	default:
+	}
+	return true
+}
+
 func removeOldCronFile() error {
 	// Remove old cron job file if it exists.
 	oldCronFile := "/etc/cron.d/salt-updater"
@@ -299,14 +698,71 @@ func checkNodeGroupChange() (bool, error) {
 		log.Errorf("Error reading salt state: %v", err)
 		return false, err
 	}
-	stateNodeGroup := strings.TrimSpace(saltState.LastCallNodegroup)
+	info, err := getNodegroupInfo(saltState)
+	if err != nil {
+		return false, err
+	}
+	return !info.Consistent, nil
+}
+
+// updateForNodegroupChange starts an update for a changed nodegroup. The latest version of the
+// new nodegroup's branch is checked first so the update records the version it applied.
+func (s *saltUpdater) updateForNodegroupChange() {
+	if err := s.claimUpdate(); err != nil {
+		log.Printf("Not running salt update for the nodegroup change: %v", err)
+		return
+	}
+	if !loadSaltConfig().UpdateCheckDisabled {
+		if _, _, err := s.checkForUpdate(); err != nil {
+			log.Printf("Error checking latest update, running update for the nodegroup change anyway: %v", err)
+		}
+	}
+	go s.runUpdate(time.Now(), saltrequester.TriggerNodegroupChange, s.jobs.add(saltrequester.TriggerNodegroupChange))
+}
+
+// shouldUpdateForNodegroupChange checks if the nodegroup has changed since the last salt call and
+// an update should be run for it, which needs auto update and update-on-nodegroup-change on.
+func (s *saltUpdater) shouldUpdateForNodegroupChange() bool {
+	saltSetup := loadSaltConfig()
+	if !saltSetup.AutoUpdate || !saltSetup.UpdateOnNodegroupChange {
+		return false
+	}
+	info, err := getNodegroupInfo(s.state)
+	if err != nil {
+		log.Errorf("Failed to check for a nodegroup change: %v", err)
+		return false
+	}
+	if !nodegroupChanged(info) {
+		return false
+	}
+	log.Printf("Nodegroup has changed (file '%s', grains '%s', last salt call '%s'), running a salt update",
+		info.FileNodegroup, info.GrainNodegroup, info.StateNodegroup)
+	return true
+}
+
+// nodegroupChanged returns true if the nodegroup file or grains don't match the nodegroup of the
+// last salt call. A device that hasn't had a salt call, or doesn't have the nodegroup grain,
+// isn't counted as a change.
+func nodegroupChanged(info *saltrequester.NodegroupInfo) bool {
+	if info.StateNodegroup == "" {
+		return false
+	}
+	if info.FileNodegroup != info.StateNodegroup {
+		return true
+	}
+	return info.GrainNodegroup != "" && info.GrainNodegroup != info.StateNodegroup
+}
+
+// getNodegroupInfo reads the nodegroup from the nodegroup file, the salt grains and the salt state.
+func getNodegroupInfo(saltState *saltrequester.SaltState) (*saltrequester.NodegroupInfo, error) {
+	stateNodeGroup := saltrequester.NormalizeNodegroup(saltState.LastCallNodegroup)
 	log.Debug("State nodegroup: " + stateNodeGroup)
 
 	// Get nodegroup from /etc/cacophony/nodegroup
-	fileNodeGroup, err := saltutil.GetNodegroupFromFile()
+	fileNodeGroup, err := saltrequester.ReadNodegroup()
 	if err != nil {
 		log.Errorf("Error reading nodegroup file: %v", err)
-		return false, err
+		return nil, err
 	}
 	log.Debug("File nodegroup: " + fileNodeGroup)
 
@@ -314,128 +770,625 @@ func checkNodeGroupChange() (bool, error) {
 	grains, err := saltutil.GetSaltGrains(log)
 	if err != nil {
 		log.Errorf("Error reading salt grains: %v", err)
-		return false, err
+		return nil, err
 	}
-	grainsNodeGroup := grains.Environment
+	grainsNodeGroup := saltrequester.NormalizeNodegroup(grains.Environment)
 	if grainsNodeGroup == "" {
 		log.Debug("No nodegroup found in grains")
 	}
 	log.Debug("Grains nodegroup: " + grainsNodeGroup)
 
-	change := grainsNodeGroup != stateNodeGroup || grainsNodeGroup != fileNodeGroup
-	return change, nil
+	branch, err := loadSaltConfig().saltBranch(fileNodeGroup)
+	if err != nil {
+		log.Errorf("Failed to resolve saltops branch: %v", err)
+	}
+
+	return &saltrequester.NodegroupInfo{
+		FileNodegroup:  fileNodeGroup,
+		GrainNodegroup: grainsNodeGroup,
+		StateNodegroup: stateNodeGroup,
+		Branch:         branch,
+		Consistent:     grainsNodeGroup == stateNodeGroup && grainsNodeGroup == fileNodeGroup,
+	}, nil
 }
 
-func runDbus() (*saltrequester.SaltState, error) {
-	//Read in previous state
-	saltState, err := saltrequester.ReadStateFile()
+// resetStartupState clears the fields of a saved state that only apply to a running process.
+// If RunningUpdate was saved as true but no salt-call is running the previous process must
+// have been stopped during a salt call, so the stale RunningUpdate is cleared. If salt-call
+// is still running RunningUpdate is kept so another salt call isn't started at the same time.
+func resetStartupState(saltState *saltrequester.SaltState, saltCallRunning bool) {
+	if saltState.RunningUpdate {
+		if saltCallRunning {
+			log.Printf("Salt call %v from previous process is still running", saltState.RunningArgs)
+		} else {
+			log.Printf("Recovered from stale running salt call %v from previous process", saltState.RunningArgs)
+			saltState.RunningUpdate = false
+			saltState.RunningArgs = nil
+		}
+	}
 	saltState.UpdateProgressPercentage = 0
 	saltState.UpdateProgressStr = ""
-	if err != nil {
-		return nil, err
-	}
-	salt := &saltUpdater{
-		state: saltState,
+}
+
+// waitForSaltCall waits for a salt-call that was started by a previous process to finish.
+func (s *saltUpdater) waitForSaltCall() {
+	for {
+		time.Sleep(10 * time.Second)
+		running, err := isSaltCallRunning()
+		if err != nil {
+			log.Errorf("Failed to check if salt-call is running: %v", err)
+		}
+		if !running {
+			break
+		}
 	}
-	go salt.modemConnectedListener()
-	if err := startService(salt); err != nil {
-		return saltState, err
+	log.Println("Salt call from previous process has finished")
+	s.releaseSaltCall()
+	if err := s.saveState(); err != nil {
+		log.Errorf("Failed to write salt state: %v", err)
 	}
-	return saltState, err
 }
 
-func (s *saltUpdater) runSaltCallSync(args []string, updateCall bool, updateTime time.Time) (*saltrequester.SaltState, error) {
-	// Don't want multiple calls running at the same time
-	if s.state.RunningUpdate {
-		return nil, errors.New("failed to run salt call as one is already running")
+// isSaltCallRunning checks if there is a salt-call process running.
+func isSaltCallRunning() (bool, error) {
+	err := exec.Command("pgrep", "-f", "salt-call").Run()
+	if err == nil {
+		return true, nil
 	}
-
-	log.Printf("Starting salt call: %v", args)
-	s.state.RunningUpdate = true
-	s.state.RunningArgs = args
-	out, err := exec.Command("salt-call", args...).CombinedOutput()
-	s.state.RunningUpdate = false
-	s.state.RunningArgs = nil
-	log.Printf("Finished salt call: %v", args)
-
-	s.state.LastCallSuccess = err == nil
-	s.state.LastCallOut = string(out)
-	if updateCall && s.state.LastCallSuccess && !updateTime.IsZero() {
-		s.state.LastUpdate = updateTime
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		// pgrep exits with 1 when no processes matched.
+		return false, nil
 	}
+	return false, err
+}
 
-	nodegroup, err := saltutil.GetNodegroupFromFile()
+// resetState clears the running salt call and progress from the state, optionally keeping the last update time.
+func (s *saltUpdater) resetState(keepLastUpdate bool) error {
+	running, err := isSaltCallRunning()
 	if err != nil {
-		log.Errorf("failed to read nodegroup file: %v", err)
-		s.state.LastCallNodegroup = "error reading nodegroup"
-	} else {
-		s.state.LastCallNodegroup = nodegroup
+		return fmt.Errorf("failed to check if salt-call is running: %v", err)
 	}
-	s.state.LastCallArgs = args
+	if running {
+		return errors.New("can not reset the salt state while salt-call is running")
+	}
+
+	log.Printf("Salt state before reset: RunningUpdate: %v, RunningArgs: %v, Progress: %d%% '%s', LastUpdate: %s",
+		s.state.RunningUpdate, s.state.RunningArgs, s.state.UpdateProgressPercentage, s.state.UpdateProgressStr, s.state.LastUpdate)
+	s.runningMu.Lock()
+	resetStartupState(s.state, false)
+	s.runningMu.Unlock()
+	if !keepLastUpdate {
+		s.state.LastUpdate = time.Time{}
+	}
+	log.Printf("Salt state after reset: RunningUpdate: %v, RunningArgs: %v, Progress: %d%% '%s', LastUpdate: %s",
+		s.state.RunningUpdate, s.state.RunningArgs, s.state.UpdateProgressPercentage, s.state.UpdateProgressStr, s.state.LastUpdate)
+	return s.saveState()
+}
 
-	err = saltrequester.WriteStateFile(s.state)
+// setLastUpdate sets the time of the last successful update. A time in the future is only
+// allowed with force as it would stop updates from running until then.
+func (s *saltUpdater) setLastUpdate(timeStr string, force bool) error {
+	lastUpdate, err := time.Parse(time.RFC3339, timeStr)
 	if err != nil {
-		log.Printf("failed to save salt JSON to file: %v\n", err)
+		return fmt.Errorf("invalid time '%s', expected RFC3339 format: %v", timeStr, err)
 	}
-	if updateCall {
-		event, err := makeEventFromState(*s.state)
-		if err != nil {
-			return nil, err
-		}
-		return s.state, eventclient.AddEvent(*event)
+	if lastUpdate.After(time.Now()) && !force {
+		return fmt.Errorf("time '%s' is in the future, use force to set it anyway", timeStr)
 	}
-	return s.state, nil
+	log.Printf("Changing last update time from %s to %s", s.state.LastUpdate.Format(time.RFC3339), lastUpdate.Format(time.RFC3339))
+	s.state.LastUpdate = lastUpdate
+	// The version and SHA of the last update no longer match, so the update check compares the time.
+	s.state.LastUpdateVersion = ""
+	s.state.LastUpdateSHA = ""
+	return s.saveState()
 }
 
-func (s *saltUpdater) runSaltCall(args []string, updateCall bool, updateTime time.Time) {
-	if s.state.RunningUpdate {
-		return
+// pauseAutoUpdate skips scheduled and manual updates for the duration, a duration of 0 or less
+// resumes them. Forced updates still run while paused.
+func (s *saltUpdater) pauseAutoUpdate(duration time.Duration) error {
+	if duration <= 0 {
+		log.Println("Resuming auto update")
+		s.state.AutoUpdatePausedUntil = time.Time{}
+	} else {
+		s.state.AutoUpdatePausedUntil = time.Now().Add(duration)
+		log.Printf("Pausing auto update until %s", s.state.AutoUpdatePausedUntil.Format(time.RFC3339))
 	}
-	go func(s *saltUpdater) {
-		s.runSaltCallSync(args, updateCall, updateTime)
-	}(s)
+	return s.saveState()
 }
 
-func trackUpdateProgress(s *saltUpdater, stop chan bool) {
-	s.state.UpdateProgressPercentage = 0
-	s.state.UpdateProgressStr = "Initializing update..."
-	log.Println("Tracking salt update progress.")
-
-	file, err := os.Open(minionLogFile)
-	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
-		return
+// setNextScheduledUpdate records when the run-dbus loop will next check for an update, the zero
+// time if no update is scheduled.
+func (s *saltUpdater) setNextScheduledUpdate(next time.Time) {
+	s.state.NextScheduledUpdate = next
+	if err := s.saveState(); err != nil {
+		log.Errorf("Failed to write salt state: %v", err)
 	}
-	defer file.Close()
-
-	file.Seek(0, io.SeekEnd)
-	reader := bufio.NewReader(file)
-	stateRe := regexp.MustCompile(`INFO\s+\]\[\d+\] Running state \[(.*)\]`)
+}
 
-	// Read totalStates from /etc/cacophony/salt-states
-	// totalStates is used to give an estimate percentage completion so doesn't need to be accurate
-	totalStatesStr, err := os.ReadFile(totalStatesCountFile)
-	if err != nil {
-		log.Printf("Error reading totalStates: %v\n", err)
+// autoUpdatePaused returns true if scheduled and manual updates are paused. An expired pause is cleared.
+func (s *saltUpdater) autoUpdatePaused() bool {
+	if s.state.AutoUpdatePausedUntil.IsZero() {
+		return false
 	}
-	totalStates, err := strconv.Atoi(strings.TrimSpace(string(totalStatesStr)))
-	if err != nil {
-		log.Printf("Error parsing totalStates: %v\n", err)
-		totalStates = 100 // Lets assume 100 if we can't get it
+	if time.Now().Before(s.state.AutoUpdatePausedUntil) {
+		return true
 	}
-	// Adding 5 more states in case there are more states than the last run
+	log.Println("Auto update pause has expired")
+	s.state.AutoUpdatePausedUntil = time.Time{}
+	if err := s.saveState(); err != nil {
+		log.Errorf("Failed to write salt state: %v", err)
+	}
+	return false
+}
+
+func runDbus() (*saltUpdater, error) {
+	//Read in previous state
+	saltState, err := saltrequester.ReadStateFile()
+	if err != nil {
+		return nil, err
+	}
+	saltCallRunning := false
+	if saltState.RunningUpdate {
+		saltCallRunning, err = isSaltCallRunning()
+		if err != nil {
+			log.Errorf("Failed to check if salt-call is running: %v", err)
+		}
+	}
+	if booted, err := bootTime(); err != nil {
+		log.Errorf("Failed to read boot time: %v", err)
+	} else {
+		checkRebootedForUpdate(saltState, booted)
+	}
+	resetStartupState(saltState, saltCallRunning)
+	if events, err := readEventQueue(); err != nil {
+		log.Errorf("Failed to read event queue: %v", err)
+	} else {
+		saltState.PendingEvents = len(events)
+	}
+	salt := &saltUpdater{
+		state:     saltState,
+		runner:    execSaltRunner{},
+		skipDelay: make(chan struct{}, 1),
+		reloaded:  make(chan struct{}, 1),
+	}
+	if saltState.RunningUpdate {
+		go salt.waitForSaltCall()
+	}
+	go salt.modemConnectedListener()
+	conn, err := startService(salt)
+	if err != nil {
+		return salt, err
+	}
+	go salt.handleShutdown(conn)
+	return salt, err
+}
+
+// handleShutdown waits for a SIGTERM or SIGINT then stops the dbus service. If a salt call
+// is running it is given the configured grace period to finish, if it doesn't finish in time
+// the state file is updated so the call isn't left marked as running.
+func (s *saltUpdater) handleShutdown(conn *dbus.Conn) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Printf("Received %v, shutting down.", sig)
+
+	if running, args := s.runningCall(); running {
+		gracePeriod := time.Duration(loadSaltConfig().ShutdownGraceSeconds) * time.Second
+		log.Printf("Waiting up to %s for salt call %v to finish.", gracePeriod, args)
+		deadline := time.Now().Add(gracePeriod)
+		for s.isRunning() && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+		}
+	}
+
+	if running, args := s.runningCall(); running {
+		log.Printf("Salt call %v did not finish before shutdown.", args)
+		s.releaseSaltCall()
+		s.state.LastCallSuccess = false
+		s.state.UpdateProgressStr = "Salt call interrupted by shutdown"
+		if err := s.saveState(); err != nil {
+			log.Errorf("Failed to write salt state: %v", err)
+		}
+	}
+
+	stopService(conn)
+	os.Exit(0)
+}
+
+func (s *saltUpdater) runSaltCallSync(args []string, updateCall bool, updateTime time.Time) (*saltrequester.SaltState, error) {
+	// Don't want multiple calls running at the same time, but an update shouldn't be skipped
+	// because of a short ping.
+	if err := s.claimSaltCall(args, !isPingCall(args)); err != nil {
+		return nil, err
+	}
+	return s.runClaimedSaltCall(args, updateCall, updateTime)
+}
+
+// runClaimedSaltCall runs a salt call that has already been claimed with claimSaltCall,
+// releasing the claim when the salt call finishes.
+func (s *saltUpdater) runClaimedSaltCall(args []string, updateCall bool, updateTime time.Time) (*saltrequester.SaltState, error) {
+	s.runningMu.Lock()
+	s.state.RunningArgs = args
+	s.runningMu.Unlock()
+	released := false
+	release := func() {
+		if !released {
+			s.releaseSaltCall()
+			released = true
+		}
+	}
+	defer release()
+	if err := validateSaltCallArgs(args, loadSaltConfig().ModuleWhitelist); err != nil {
+		return nil, fmt.Errorf("invalid salt call: %v", err)
+	}
+
+	unlock, err := lockSaltCall()
+	if errors.Is(err, errSaltCallLocked) {
+		log.Printf("Not running salt call %v: %v", args, err)
+		return nil, err
+	}
+	if err != nil {
+		// Still run the salt call as the lock is only a safeguard.
+		log.Errorf("Failed to take salt call lock: %v", err)
+	} else {
+		defer unlock()
+	}
+
+	log.Printf("Starting salt call: %v", args)
+	if updateCall {
+		s.state.LastAttempt = time.Now()
+		// Saved so an update interrupted by a reboot can be seen when the service starts again.
+		if err := s.saveState(); err != nil {
+			log.Errorf("Failed to write salt state: %v", err)
+		}
+	} else {
+		s.stateChanged()
+	}
+	result := s.runSaltCommand(args)
+	release()
+	log.Printf("Finished salt call: %v", args)
+	state, err := s.recordSaltCall(args, result, updateCall, updateTime)
+	if err == nil && !updateCall && isPingCall(args) && pingEvents {
+		if err := addEvent(makePingEvent(*state, result.duration)); err != nil {
+			log.Errorf("Failed to add salt ping event: %v", err)
+		}
+	}
+	return state, err
+}
+
+// saltCallResult is the output of a salt call before it is recorded in the salt state.
+type saltCallResult struct {
+	out      []byte
+	err      error
+	duration time.Duration
+}
+
+// runSaltCommand runs salt-call with the global args from the config. The salt call must
+// already be claimed.
+func (s *saltUpdater) runSaltCommand(args []string) *saltCallResult {
+	callStart := time.Now()
+	stdout, stderr, err := s.runner.Run(append(loadSaltConfig().saltCallGlobalArgs(args), args...))
+	return &saltCallResult{
+		out:      append(stdout, stderr...),
+		err:      err,
+		duration: time.Since(callStart),
+	}
+}
+
+// runUnrecordedSaltCall runs a salt call without recording it in the salt state or sending an
+// event, e.g. a ping that is retried. It is claimed and takes the salt call lock like any other
+// salt call, an error is returned if it couldn't run.
+func (s *saltUpdater) runUnrecordedSaltCall(args []string) (*saltCallResult, error) {
+	if err := s.claimSaltCall(args, false); err != nil {
+		return nil, err
+	}
+	defer s.releaseSaltCall()
+	return s.runLockedSaltCommand(args)
+}
+
+// runLockedSaltCommand runs a salt call with the salt call lock held. The salt call must already
+// be claimed, an error is returned if the lock is held by another process.
+func (s *saltUpdater) runLockedSaltCommand(args []string) (*saltCallResult, error) {
+	unlock, err := lockSaltCall()
+	if errors.Is(err, errSaltCallLocked) {
+		return nil, err
+	}
+	if err != nil {
+		// Still run the salt call as the lock is only a safeguard.
+		log.Errorf("Failed to take salt call lock: %v", err)
+	} else {
+		defer unlock()
+	}
+	return s.runSaltCommand(args), nil
+}
+
+// recordSaltCall records the result of a finished salt call in the salt state and sends its event.
+func (s *saltUpdater) recordSaltCall(args []string, result *saltCallResult, updateCall bool, updateTime time.Time) (*saltrequester.SaltState, error) {
+	out, err := result.out, result.err
+	jsonSummary, _ := parseSaltJSON(string(out))
+	s.state.LastCallSuccess = callSucceeded(out, err, jsonSummary)
+	// Only the end of the output is kept to bound memory use, the summary is at the end.
+	s.state.LastCallOut = truncateHead(string(out), lastCallOutMaxBytes)
+	if updateCall {
+		if s.state.LastCallSuccess {
+			s.state.ConsecutiveFailures = 0
+		} else {
+			s.state.ConsecutiveFailures++
+		}
+	}
+	if updateCall && s.state.LastCallSuccess && !updateTime.IsZero() {
+		s.state.LastUpdate = updateTime
+		s.state.LastUpdateVersion = s.state.AvailableVersion
+		s.state.LastUpdateSHA = s.state.AvailableSHA
+	}
+	if updateCall {
+		runTime, err := parseRunTime(string(out), jsonSummary)
+		if err != nil {
+			log.Errorf("failed to parse salt run time: %v", err)
+		}
+		s.state.LastRunTimeSeconds = runTime
+		s.state.LastChanges = parseChanges(string(out), jsonSummary)
+		s.state.LastCallSummary, err = parseStateSummary(string(out), jsonSummary)
+		if err != nil {
+			log.Errorf("failed to parse salt summary: %v", err)
+		}
+		s.state.RebootPending = updateNeedsReboot(string(out))
+		s.state.RebootedForUpdate = false
+		if s.state.RebootPending {
+			log.Println("Salt update needs a reboot to finish")
+		}
+	} else {
+		s.state.LastCallSummary = nil
+	}
+
+	nodegroup, err := saltrequester.ReadNodegroup()
+	if err != nil {
+		log.Errorf("failed to read nodegroup file: %v", err)
+		s.state.LastCallNodegroup = "error reading nodegroup"
+		s.state.LastCallBranch = ""
+	} else {
+		s.state.LastCallNodegroup = nodegroup
+		branch, err := loadSaltConfig().saltBranch(nodegroup)
+		if err != nil {
+			log.Errorf("failed to resolve saltops branch: %v", err)
+		}
+		s.state.LastCallBranch = branch
+	}
+	s.state.LastCallArgs = args
+	s.state.LastCallLocalPath = localFileRoot(args)
+
+	err = s.saveState()
+	if err != nil {
+		log.Printf("failed to save salt JSON to file: %v\n", err)
+	}
+	if updateCall {
+		// Make the event from the full output so no failed states are missed.
+		eventState := *s.state
+		eventState.LastCallOut = string(out)
+		event, err := makeEventFromState(eventState)
+		if err != nil {
+			return nil, err
+		}
+		// The update has finished, failing to report it doesn't make the update fail.
+		// The event is queued to be sent again so the result isn't lost.
+		s.addEventOrQueue(*event)
+		// Only sent when the threshold is reached so a stuck device doesn't send one for every retry.
+		if repeatedFailureThreshold > 0 && s.state.ConsecutiveFailures == repeatedFailureThreshold {
+			log.Printf("Salt update has failed %d times in a row", s.state.ConsecutiveFailures)
+			s.addEventOrQueue(makeRepeatedFailureEvent(*s.state))
+		}
+	}
+	return s.state, nil
+}
+
+// runModule runs a salt function from the module whitelist, returning its output. These are
+// read only diagnostic functions so the call doesn't count as an update.
+func (s *saltUpdater) runModule(name string) (string, error) {
+	if !slices.Contains(loadSaltConfig().ModuleWhitelist, name) {
+		return "", fmt.Errorf("salt module '%s' is not in the module whitelist", name)
+	}
+	state, err := s.runSaltCallSync([]string{name}, false, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if !state.LastCallSuccess {
+		return state.LastCallOut, fmt.Errorf("salt module '%s' failed: %s", name, tailLines(state.LastCallOut, 5))
+	}
+	return state.LastCallOut, nil
+}
+
+// runSaltCall starts a salt call without waiting for it to finish, returning an error if it
+// can't start because another salt call is running.
+func (s *saltUpdater) runSaltCall(args []string, updateCall bool, updateTime time.Time) error {
+	if err := s.busyError(); err != nil {
+		return err
+	}
+	go func(s *saltUpdater) {
+		s.runSaltCallSync(args, updateCall, updateTime)
+	}(s)
+	return nil
+}
+
+var (
+	errUpdateRunning = errors.New("a salt update is running, try again when it has finished")
+	errPingRunning   = errors.New("a salt ping is running, try again when it has finished")
+)
+
+// pingWaitTimeout is how long an update waits for a running salt ping to finish.
+const pingWaitTimeout = time.Minute
+
+// isPingCall returns true if the salt call args are for a salt ping.
+func isPingCall(args []string) bool {
+	return slices.Contains(args, "test.ping")
+}
+
+// runningCall returns if a salt call is running and its args.
+func (s *saltUpdater) runningCall() (bool, []string) {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	return s.state.RunningUpdate, s.state.RunningArgs
+}
+
+// isRunning returns true if a salt call is running.
+func (s *saltUpdater) isRunning() bool {
+	running, _ := s.runningCall()
+	return running
+}
+
+// busyError returns the error for why another salt call can't start, or nil if no salt call is running.
+func (s *saltUpdater) busyError() error {
+	running, args := s.runningCall()
+	if !running {
+		return nil
+	}
+	if isPingCall(args) {
+		return errPingRunning
+	}
+	return errUpdateRunning
+}
+
+// claimSaltCall marks a salt call with the args as running, returning the reason if another salt
+// call is already running. Checking and marking are done together so two salt calls can't both
+// start. If waitForPing is set a running salt ping is waited for, pings are short so an update
+// waits for the ping instead of being skipped. releaseSaltCall must be called when the call ends.
+func (s *saltUpdater) claimSaltCall(args []string, waitForPing bool) error {
+	deadline := time.Now().Add(pingWaitTimeout)
+	for {
+		s.runningMu.Lock()
+		if !s.state.RunningUpdate {
+			s.state.RunningUpdate = true
+			s.state.RunningArgs = args
+			s.runningMu.Unlock()
+			return nil
+		}
+		pingRunning := isPingCall(s.state.RunningArgs)
+		s.runningMu.Unlock()
+		if !pingRunning {
+			return errUpdateRunning
+		}
+		if !waitForPing || time.Now().After(deadline) {
+			return errPingRunning
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// claimUpdate claims the salt call for an update, waiting for a running salt ping to finish.
+// The update is run with runUpdate which releases the claim.
+func (s *saltUpdater) claimUpdate() error {
+	return s.claimSaltCall([]string{"state.apply"}, true)
+}
+
+// releaseSaltCall marks the running salt call as finished.
+func (s *saltUpdater) releaseSaltCall() {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	s.state.RunningUpdate = false
+	s.state.RunningArgs = nil
+	s.stateChanged()
+}
+
+// readTotalStatesCount reads the number of states in the last successful update,
+// returning defaultCount if it can't be read.
+func readTotalStatesCount(defaultCount int) int {
+	totalStatesStr, err := os.ReadFile(totalStatesCountFile)
+	if err != nil {
+		log.Printf("Error reading totalStates: %v\n", err)
+		return defaultCount
+	}
+	totalStates, err := strconv.Atoi(strings.TrimSpace(string(totalStatesStr)))
+	if err != nil {
+		log.Printf("Error parsing totalStates: %v\n", err)
+		return defaultCount
+	}
+	return totalStates
+}
+
+// calibrateTotalStatesCount saves the number of states run by the update to estimate the progress
+// of the next update. Only a successful update is used, an update that stopped early would make
+// the next estimate too low.
+func calibrateTotalStatesCount(state saltrequester.SaltState) {
+	if !state.LastCallSuccess {
+		return
+	}
+	// The saved summary is used if there is one so the output isn't parsed again.
+	if state.LastCallSummary != nil && state.LastCallSummary.Total > 0 {
+		saveTotalStatesCount(state.LastCallSummary.Total)
+		return
+	}
+	jsonSummary, _ := parseSaltJSON(state.LastCallOut)
+	if totalStates, ok := parseTotalStatesRun(state.LastCallOut, jsonSummary); ok {
+		saveTotalStatesCount(totalStates)
+	}
+}
+
+// saveTotalStatesCount saves the number of states in an update so it can be used to estimate
+// the progress of the next update.
+func saveTotalStatesCount(totalStates int) {
+	err := os.WriteFile(totalStatesCountFile, []byte(fmt.Sprintf("%d", totalStates)), 0644)
+	if err != nil {
+		log.Printf("Error writing totalStates: %v\n", err)
+	}
+}
+
+// trackUpdateProgress follows the minion log to track the progress of an update until it is stopped.
+func trackUpdateProgress(s *saltUpdater, stop chan bool) {
+	s.state.UpdateProgressPercentage = 0
+	s.state.UpdateProgressStr = "Initializing update..."
+	s.state.AppliedStates = nil
+	s.state.EstimatedSecondsRemaining = saltrequester.UnknownTimeRemaining
+	s.stateChanged()
+	log.Println("Tracking salt update progress.")
+
+	saltSetup := loadSaltConfig()
+	file, err := os.Open(saltSetup.MinionLogFile)
+	if err != nil {
+		if !s.minionLogMissingLogged {
+			log.Errorf("Can't track salt update progress: %v", err)
+			s.minionLogMissingLogged = true
+		}
+		s.state.UpdateProgressStr = "Progress unavailable (no minion log)"
+		s.stateChanged()
+		// The update still runs, wait for it to finish.
+		<-stop
+		return
+	}
+	defer file.Close()
+
+	file.Seek(0, io.SeekEnd)
+	reader := bufio.NewReader(file)
+	stateRe := regexp.MustCompile(`INFO\s+\]\[\d+\] Running state \[(.*)\]`)
+
+	// totalStates is used to give an estimate percentage completion so doesn't need to be accurate
+	totalStates := readTotalStatesCount(saltSetup.DefaultTotalStates)
+	milestones := newProgressMilestones(saltSetup.ProgressEventMilestones, time.Duration(saltSetup.ProgressEventMinSeconds)*time.Second)
+	// Estimate the time per state from the last run, if there is no history the time remaining is unknown.
+	secondsPerState := 0.0
+	if totalStates > 0 && s.state.LastRunTimeSeconds > 0 {
+		secondsPerState = s.state.LastRunTimeSeconds / float64(totalStates)
+	}
+	// Adding 5 more states in case there are more states than the last run
 	totalStates += 5
 
 	stateCount := 0
+	timer := &stateTimer{}
+	s.state.SlowestState = ""
+	s.state.SlowestStateSeconds = 0
 	for {
 		// Loop until we get a signal to stop
 		select {
 		case <-stop:
 			log.Println("Stopped tracking salt update progress.")
-			// Save totalStates to file so can be reloaded on next run
-			err = os.WriteFile(totalStatesCountFile, []byte(fmt.Sprintf("%d", stateCount)), 0644)
-			if err != nil {
-				log.Printf("Error writing totalStates: %v\n", err)
+			timer.finish(time.Now())
+			s.state.SlowestState = timer.slowest
+			s.state.SlowestStateSeconds = timer.slowestSeconds
+			s.stateChanged()
+			if timer.slowest != "" {
+				log.Printf("Slowest state was %s, taking %.3fs", timer.slowest, timer.slowestSeconds)
+				if err := s.saveState(); err != nil {
+					log.Errorf("Failed to write salt state: %v", err)
+				}
 			}
 			return
 		default:
@@ -455,142 +1408,569 @@ func trackUpdateProgress(s *saltUpdater, stop chan bool) {
 
 			stateCount++
 			state := matches[1]
+			timer.next(state, time.Now())
 			log.Printf("Running %d/%d state: %s\n", stateCount, totalStates, state)
 			s.state.UpdateProgressPercentage = 100 * stateCount / totalStates
 			s.state.UpdateProgressStr = state
+			if secondsPerState > 0 {
+				s.state.EstimatedSecondsRemaining = int(secondsPerState * float64(max(totalStates-stateCount, 0)))
+			}
+			if milestone, ok := milestones.reached(s.state.UpdateProgressPercentage, time.Now()); ok {
+				go sendProgressEvent(milestone, s.state.UpdateProgressPercentage, state)
+			}
+			if len(s.state.AppliedStates) < maxAppliedStates {
+				s.state.AppliedStates = append(s.state.AppliedStates, state)
+			}
+			s.stateChanged()
 		}
 	}
 }
 
+// runUpdateIfAvailable starts a salt update if there is an update available, returning the ID of
+// the update job and true if the update was started. If the update check fails for a reason other
+// than being offline the update is run anyway.
+func (s *saltUpdater) runUpdateIfAvailable(trigger saltrequester.UpdateTrigger) (string, bool) {
+	jobID := s.jobs.add(trigger)
+	// The salt call is claimed while checking for an update so another update can't start
+	// between the check and this update starting.
+	if err := s.claimUpdate(); err != nil {
+		log.Printf("Not checking for an update: %v", err)
+		s.jobs.finish(jobID, saltrequester.JobSkipped, err.Error())
+		return jobID, false
+	}
+	skip := func(reason string) (string, bool) {
+		s.releaseSaltCall()
+		s.jobs.finish(jobID, saltrequester.JobSkipped, reason)
+		return jobID, false
+	}
+	if s.autoUpdatePaused() {
+		log.Printf("Auto update is paused until %s, skipping update", s.state.AutoUpdatePausedUntil.Format(time.RFC3339))
+		return skip("Auto update is paused until " + s.state.AutoUpdatePausedUntil.Format(time.RFC3339))
+	}
+	if loadSaltConfig().UpdateCheckDisabled {
+		log.Println("Online update check is disabled, running salt update")
+		go s.runUpdate(time.Now(), trigger, jobID)
+		return jobID, true
+	}
+	updateAvailable, updateTime, err := s.checkForUpdate()
+	if errors.Is(err, saltrequester.ErrOffline) {
+		log.Println("Device is offline, will retry on next update check")
+		return skip("Device is offline")
+	}
+	if errors.Is(err, saltrequester.ErrUnknownNodegroup) {
+		if s.unknownNodegroupErr != err.Error() {
+			log.Infof("Unknown nodegroup, skipping update check: %v", err)
+			s.unknownNodegroupErr = err.Error()
+		}
+		return skip(err.Error())
+	}
+	s.unknownNodegroupErr = ""
+	if errors.Is(err, saltrequester.ErrBranchNotFound) {
+		log.Printf("Skipping update: %v", err)
+		return skip(err.Error())
+	}
+	if err != nil {
+		log.Printf("Error checking if update exists %v will run salt state", err)
+	}
+	//if we have an error lets just run salt update
+	if err == nil && !updateAvailable {
+		s.state.UpdateProgressPercentage = 100
+		s.state.UpdateProgressStr = "No update available"
+		s.stateChanged()
+		log.Println("No update available")
+		nodegroup, err := saltrequester.ReadNodegroup()
+		if err != nil {
+			log.Errorf("Failed to read nodegroup file: %v", err)
+		}
+		if err := addEvent(makeSkippedEvent(nodegroup, updateTime)); err != nil {
+			log.Errorf("Failed to add salt update skipped event: %v", err)
+		}
+		return skip("No update available")
+	}
+
+	go s.runUpdate(updateTime, trigger, jobID)
+	return jobID, true
+}
+
+// forceUpdate runs a salt update even if there is no update available. The latest version
+// is still checked, bypassing the cache, so the state records what version was applied.
+func (s *saltUpdater) forceUpdate(jobID string) {
+	if err := s.claimUpdate(); err != nil {
+		log.Printf("Not forcing a salt update: %v", err)
+		s.jobs.finish(jobID, saltrequester.JobSkipped, err.Error())
+		return
+	}
+	if !loadSaltConfig().UpdateCheckDisabled {
+		saltrequester.ClearUpdateCache()
+		if _, _, err := s.checkForUpdate(); err != nil {
+			log.Printf("Error checking latest update, forcing update anyway: %v", err)
+		}
+	}
+	s.runUpdate(time.Now(), saltrequester.TriggerForce, jobID)
+}
+
+// checkSaltVersion checks that the installed salt minion is at least the minimum
+// version configured for the nodegroup's saltops branch.
+func (s *saltUpdater) checkSaltVersion() error {
+	saltVersion, err := getSaltVersion()
+	if err != nil {
+		// Don't stop the update if the version can't be read, salt-call will report the real problem.
+		log.Errorf("Failed to check salt version: %v", err)
+		return nil
+	}
+	s.state.SaltVersion = saltVersion
+	s.stateChanged()
+	log.Debugf("Salt version: %s", saltVersion)
+
+	saltSetup, err := readSaltConfig()
+	if err != nil {
+		log.Errorf("Failed to read salt config: %v", err)
+		return nil
+	}
+	nodegroup, err := saltrequester.ReadNodegroup()
+	if err != nil {
+		log.Errorf("Failed to read nodegroup file: %v", err)
+		return nil
+	}
+	branch, ok := saltrequester.NodegroupBranch(nodegroup)
+	if !ok {
+		return nil
+	}
+	minVersion, ok := saltSetup.MinSaltVersions[branch]
+	if !ok || minVersion == "" {
+		return nil
+	}
+	cmp, err := compareSaltVersions(saltVersion, minVersion)
+	if err != nil {
+		log.Errorf("Failed to compare salt versions: %v", err)
+		return nil
+	}
+	if cmp < 0 {
+		return fmt.Errorf("salt version %s is older than the minimum version %s needed for the %s branch", saltVersion, minVersion, branch)
+	}
+	return nil
+}
+
+// checkForUpdate checks if there is an update for the pinned saltops ref or, if not pinned,
+// for the nodegroup's branch. The latest version found is saved in the state.
+func (s *saltUpdater) checkForUpdate() (bool, time.Time, error) {
+	saltSetup := loadSaltConfig()
+	var updateAvailable bool
+	var info *saltrequester.UpdateInfo
+	var err error
+	if saltSetup.PinnedRef != "" {
+		updateAvailable, info, err = saltrequester.UpdateExistsForRef(saltSetup.PinnedRef)
+	} else if saltSetup.BranchOverride != "" {
+		log.Printf("Saltops branch override is active, checking branch '%s'", saltSetup.BranchOverride)
+		updateAvailable, info, err = updateExistsForBranchOverride(saltSetup.BranchOverride)
+	} else {
+		updateAvailable, info, err = saltrequester.UpdateExistsWithInfo(saltSetup.Channel)
+	}
+	if err != nil {
+		// Don't leave the version from an earlier check to be recorded by an update.
+		s.state.AvailableVersion = ""
+		s.state.AvailableSHA = ""
+		s.stateChanged()
+		return false, time.Time{}, err
+	}
+	s.state.AvailableVersion = info.Version
+	s.state.AvailableSHA = info.CommitSHA
+	s.stateChanged()
+	if updateAvailable && info.Version != "" {
+		log.Printf("Saltops version %s is available", info.Version)
+	}
+	return updateAvailable, info.CommitDate, nil
+}
+
+// updateExistsForBranchOverride checks if the branch override has been updated. A branch that isn't
+// in the salt-version-info json, e.g. a new canary branch, is checked as a saltops ref instead.
+// If that fails too the error wraps saltrequester.ErrBranchNotFound so the update is skipped
+// rather than applying the override blindly.
+func updateExistsForBranchOverride(branch string) (bool, *saltrequester.UpdateInfo, error) {
+	updateAvailable, info, err := saltrequester.UpdateExistsForBranch(branch)
+	if !errors.Is(err, saltrequester.ErrBranchNotFound) {
+		return updateAvailable, info, err
+	}
+	log.Printf("Saltops branch override '%s' is not in the version info, checking it as a ref", branch)
+	updateAvailable, info, refErr := saltrequester.UpdateExistsForRef(branch)
+	if refErr != nil {
+		return false, nil, fmt.Errorf("%w, checking it as a ref failed: %v", err, refErr)
+	}
+	return updateAvailable, info, nil
+}
+
+// updateSaltEnv returns the salt environment an update should apply. This is the pinned ref or
+// branch override if there is one, or the channel's branch when not on the stable channel.
+// Salt gitfs maps saltops branches and tags to salt environments. An empty environment leaves
+// it to the salt master.
+func updateSaltEnv() string {
+	saltSetup := loadSaltConfig()
+	if saltSetup.PinnedRef != "" {
+		log.Printf("Updates are pinned to saltops ref '%s'", saltSetup.PinnedRef)
+		return saltSetup.PinnedRef
+	}
+	if saltSetup.BranchOverride != "" {
+		log.Printf("Saltops branch override is active, using saltops branch '%s'", saltSetup.BranchOverride)
+		return saltSetup.BranchOverride
+	}
+	if saltSetup.Channel == "" || saltSetup.Channel == saltrequester.ChannelStable {
+		return ""
+	}
+	nodegroup, err := saltrequester.ReadNodegroup()
+	if err != nil {
+		log.Errorf("Failed to read nodegroup file: %v", err)
+		return ""
+	}
+	branch, err := saltrequester.ResolveBranch(nodegroup, saltSetup.Channel)
+	if err != nil {
+		log.Errorf("Failed to resolve saltops branch: %v", err)
+		return ""
+	}
+	log.Printf("Updates are on the %s channel, using saltops branch '%s'", saltSetup.Channel, branch)
+	return branch
+}
+
 func (s *saltUpdater) CheckIfUpdateAvailable() bool {
 	_, _, err := saltrequester.UpdateExists()
 	return err == nil
 }
 
-func (s *saltUpdater) runUpdate(updateTime time.Time) {
-	if s.state.RunningUpdate {
-		log.Println("Already running salt update")
+// runUpdate runs a salt update. The salt call must have been claimed with claimUpdate, the claim
+// is released when the update finishes or is stopped.
+func (s *saltUpdater) runUpdate(updateTime time.Time, trigger saltrequester.UpdateTrigger, jobID string) {
+	log.Printf("Starting %s salt update, job %s", trigger, jobID)
+	s.jobs.start(jobID)
+	s.state.LastTrigger = trigger
+	s.state.JobID = jobID
+	s.stateChanged()
+
+	if err := s.checkSaltVersion(); err != nil {
+		log.Errorf("Not running salt update: %v", err)
+		s.releaseSaltCall()
+		s.jobs.finish(jobID, saltrequester.JobFailed, err.Error())
+		s.state.LastCallSuccess = false
+		s.state.UpdateProgressStr = err.Error()
+		if err := s.saveState(); err != nil {
+			log.Errorf("Failed to write salt state: %v", err)
+		}
 		return
 	}
 
+	saltSetup := loadSaltConfig()
+	if err := checkDiskSpace(saltSetup.DiskSpacePaths, saltSetup.MinFreeDiskMB); err != nil {
+		log.Errorf("Not running salt update: %v", err)
+		s.releaseSaltCall()
+		s.jobs.finish(jobID, saltrequester.JobSkipped, err.Error())
+		s.state.UpdateProgressStr = err.Error()
+		if err := s.saveState(); err != nil {
+			log.Errorf("Failed to write salt state: %v", err)
+		}
+		var lowDiskErr *lowDiskSpaceError
+		if errors.As(err, &lowDiskErr) {
+			nodegroup, _ := saltrequester.ReadNodegroup()
+			if err := addEvent(makeLowDiskSpaceEvent(lowDiskErr, nodegroup)); err != nil {
+				log.Errorf("Failed to add low disk space event: %v", err)
+			}
+		}
+		return
+	}
+
+	// Released after the update has finished, even if it failed.
+	releaseStayOn := requestStayOn()
+	defer releaseStayOn()
+
 	stopTrackingUpdate := make(chan bool)
 	defer func() { stopTrackingUpdate <- true }()
 	go trackUpdateProgress(s, stopTrackingUpdate)
 
-	_, err := s.runSaltCallSync([]string{"state.apply", "--state-output=mixed", "--output-diff"}, true, updateTime)
+	args := append([]string{"state.apply"}, updateOutputArgs()...)
+	if saltEnv := updateSaltEnv(); saltEnv != "" {
+		args = append(args, "saltenv="+saltEnv)
+	}
+
+	state, err := s.runClaimedSaltCall(args, true, updateTime)
+	if state != nil {
+		calibrateTotalStatesCount(*state)
+		if err := addHistory(makeUpdateRecord(*state)); err != nil {
+			log.Errorf("Failed to add update to the history: %v", err)
+		}
+		runUpdateHooks(*state)
+	}
 	if err != nil {
 		log.Printf("error running salt update: %v", err)
+		s.jobs.finish(jobID, saltrequester.JobFailed, err.Error())
 		return
 	}
+	if state.LastCallSuccess {
+		s.jobs.finish(jobID, saltrequester.JobSucceeded, "Finished update")
+	} else {
+		s.jobs.finish(jobID, saltrequester.JobFailed, "Salt update failed")
+	}
 
 	log.Println("Finished running salt update")
+	s.state.EstimatedSecondsRemaining = 0
 	s.state.UpdateProgressPercentage = 100
 	s.state.UpdateProgressStr = "Finished update"
+	s.stateChanged()
 }
 
-func makeEventFromState(state saltrequester.SaltState) (*eventclient.Event, error) {
+// applyLocal applies the salt states from a local saltops directory, used for testing salt states
+// without pushing them to git. This is not counted as an update so doesn't change LastUpdate.
+func (s *saltUpdater) applyLocal(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", path)
+	}
+	args := append([]string{"--local", localFileRootArg + path, "state.apply"}, updateOutputArgs()...)
+	// Claimed before returning so a rejected apply is reported to the caller and doesn't touch
+	// the progress of the salt call that is running.
+	if err := s.claimSaltCall(args, true); err != nil {
+		return err
+	}
 
-	outLines := strings.Split(state.LastCallOut, "\n")
+	go func() {
+		stopTrackingUpdate := make(chan bool)
+		defer func() { stopTrackingUpdate <- true }()
+		go trackUpdateProgress(s, stopTrackingUpdate)
 
-	var succeeded, changed, failed, runTime float64
+		log.Printf("Applying local salt states from '%s'", path)
+		if _, err := s.runClaimedSaltCall(args, false, time.Time{}); err != nil {
+			log.Errorf("Error applying local salt states: %v", err)
+			return
+		}
+		s.state.UpdateProgressPercentage = 100
+		s.state.UpdateProgressStr = "Finished local apply"
+		s.stateChanged()
+	}()
+	return nil
+}
 
-	for _, line := range outLines {
-		if strings.HasPrefix(line, "Succeeded:") {
-			numbers := extractNumbers(line)
-			if len(numbers) != 2 {
-				return nil, errors.New("failed to parse output of salt update")
-			}
-			succeeded = numbers[0]
-			changed = numbers[1]
+const localFileRootArg = "--file-root="
+
+// localFileRoot returns the local file root from the salt call args, or empty if not a local apply.
+func localFileRoot(args []string) string {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, localFileRootArg) {
+			return strings.TrimPrefix(arg, localFileRootArg)
 		}
-		if strings.HasPrefix(line, "Failed:") {
-			numbers := extractNumbers(line)
-			if len(numbers) != 1 {
-				return nil, errors.New("failed to parse output of salt update")
-			}
-			failed = numbers[0]
+	}
+	return ""
+}
+
+// makeEventFromState makes the salt-update event for the last salt call. The summary saved in the
+// state is used if there is one, otherwise the summary and run time are parsed from the output.
+func makeEventFromState(state saltrequester.SaltState) (*eventclient.Event, error) {
+	jsonSummary, _ := parseSaltJSON(state.LastCallOut)
+	summary := state.LastCallSummary
+	runTime := state.LastRunTimeSeconds
+	if summary == nil {
+		var err error
+		if summary, err = parseStateSummary(state.LastCallOut, jsonSummary); err != nil {
+			return nil, err
 		}
-		if strings.HasPrefix(line, "Total run time:") {
-			numbers := extractNumbers(line)
-			if len(numbers) != 1 {
-				return nil, errors.New("failed to parse output of salt update")
-			}
-			runTime = numbers[0]
+		if summary == nil {
+			summary = &saltrequester.StateSummary{}
+		}
+		if runTime, err = parseRunTime(state.LastCallOut, jsonSummary); err != nil {
+			return nil, err
 		}
 	}
+	succeeded := float64(summary.Succeeded)
+	changed := float64(summary.Changed)
+	failed := float64(summary.Failed)
 
 	details := map[string]interface{}{
-		"changed":   changed,
-		"failed":    failed,
-		"succeeded": succeeded,
-		"nodegroup": state.LastCallNodegroup,
-		"success":   state.LastCallSuccess,
-		"args":      state.LastCallArgs,
-		"minionID":  minionID,
+		"changed":       changed,
+		"hadChanges":    changed > 0,
+		"failed":        failed,
+		"succeeded":     succeeded,
+		"nodegroup":     state.LastCallNodegroup,
+		"success":       state.LastCallSuccess,
+		"args":          state.LastCallArgs,
+		"minionID":      minionID,
+		"runTime":       runTime,
+		"trigger":       string(state.LastTrigger),
+		"rebootPending": state.RebootPending,
 	}
 
 	// if some failed add more details
 	if failed > 0 || !state.LastCallSuccess {
-		details["out"] = state.LastCallOut
-		details["runTime"] = runTime
+		// The end of the output is kept as that is where the failures and summary are.
+		details["out"] = truncateHead(state.LastCallOut, eventOutMaxBytes)
+		details["outLength"] = len(state.LastCallOut)
+		details["failedStates"] = parseFailedStates(state.LastCallOut, jsonSummary)
 	}
 
 	event := &eventclient.Event{
 		Timestamp: time.Now(),
 		Details:   details,
-		Type:      "salt-update",
+		Type:      eventType("salt-update"),
 	}
 	return event, nil
 }
 
-func extractNumbers(str string) []float64 {
-	re := regexp.MustCompile(`[-]?\d[\d,]*[\.]?[\d{2}]*`)
-	numberStrings := re.FindAllString(str, -1)
-	results := make([]float64, len(numberStrings))
-	for i, numberString := range numberStrings {
-		n, _ := strconv.ParseFloat(numberString, 64)
-		results[i] = n
+// resendEvent sends the salt-update event for the last salt call in the state file again,
+// used for debugging the event pipeline without running salt. The event has "resent" set.
+func resendEvent() error {
+	state, err := saltrequester.StateFromFile()
+	if err != nil {
+		return fmt.Errorf("failed to read salt state file: %v", err)
 	}
-	return results
+	if !slices.Contains(state.LastCallArgs, "state.apply") {
+		log.Warnf("Last salt call %v was not an update", state.LastCallArgs)
+	}
+	event, err := makeEventFromState(*state)
+	if err != nil {
+		return fmt.Errorf("failed to make event from salt state: %v", err)
+	}
+	event.Details["resent"] = true
+	log.Printf("Sending %s event: %+v", event.Type, event.Details)
+	return addEvent(*event)
 }
 
-func setAutoUpdate(enable bool) error {
-	config, err := goconfig.New(configDir)
-	if err != nil {
-		return err
+// makePingEvent makes an event for the result of a salt ping, the latency is how long the salt call took.
+func makePingEvent(state saltrequester.SaltState, latency time.Duration) eventclient.Event {
+	return eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      eventType("salt-ping"),
+		Details: map[string]interface{}{
+			"success":   state.LastCallSuccess,
+			"latencyMs": latency.Milliseconds(),
+			"nodegroup": state.LastCallNodegroup,
+			"minionID":  minionID,
+		},
 	}
-	var saltSetup = goconfig.DefaultSalt()
-	if err := config.Unmarshal(goconfig.SaltKey, &saltSetup); err != nil {
-		return err
+}
+
+// makeRepeatedFailureEvent makes an event for when updates have failed repeatedFailureThreshold times in a row.
+func makeRepeatedFailureEvent(state saltrequester.SaltState) eventclient.Event {
+	return eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      eventType("salt-update-repeated-failure"),
+		Details: map[string]interface{}{
+			"consecutiveFailures": state.ConsecutiveFailures,
+			"lastUpdate":          state.LastUpdate.Format(time.RFC3339),
+			"nodegroup":           state.LastCallNodegroup,
+			"minionID":            minionID,
+		},
 	}
-	saltSetup.AutoUpdate = enable
-	return config.Set(goconfig.SaltKey, &saltSetup)
 }
 
-func isAutoUpdateOn() (bool, error) {
-	config, err := goconfig.New(configDir)
-	if err != nil {
-		return false, err
+// makeSkippedEvent makes an event for when an update check found no update to apply.
+func makeSkippedEvent(nodegroup string, latestUpdateTime time.Time) eventclient.Event {
+	return eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      eventType("salt-update-skipped"),
+		Details: map[string]interface{}{
+			"nodegroup":        nodegroup,
+			"latestUpdateTime": latestUpdateTime.Format(time.RFC3339),
+			"minionID":         minionID,
+		},
 	}
-	var saltSetup = goconfig.DefaultSalt()
-	if err := config.Unmarshal(goconfig.SaltKey, &saltSetup); err != nil {
-		return false, err
+}
+
+func extractNumbers(str string) []float64 {
+	re := regexp.MustCompile(`[-]?\d[\d,]*[\.]?[\d{2}]*`)
+	numberStrings := re.FindAllString(str, -1)
+	results := make([]float64, len(numberStrings))
+	for i, numberString := range numberStrings {
+		n, _ := strconv.ParseFloat(numberString, 64)
+		results[i] = n
 	}
-	return saltSetup.AutoUpdate, nil
+	return results
 }
 
 func (s *saltUpdater) modemConnectedListener() {
+	if saltSetup, err := readSaltConfig(); err == nil && saltSetup.ModemConnectAction == modemConnectActionNone {
+		log.Println("Modem connect action is disabled.")
+		return
+	}
 	modemConnectSignal, err := modemlistener.GetModemConnectedSignalListener()
 	if err != nil {
 		log.Println("Failed to get modem connected signal listener")
 		return
 	}
+	var lastAction time.Time
 	for {
 		// Empty modemConnectSignal channel so as to not trigger from old signals
 		emptyChannel(modemConnectSignal)
 		<-modemConnectSignal
 		log.Println("Modem connected.")
-		s.runSaltCall([]string{"test.ping"}, false, time.Now())
+		s.retryQueuedEvents()
+
+		saltSetup := loadSaltConfig()
+		debounce := time.Duration(saltSetup.ModemConnectDebounceMinutes) * time.Minute
+		if time.Since(lastAction) < debounce {
+			log.Printf("Modem connect action was run less than %s ago, skipping.", debounce)
+			continue
+		}
+
+		switch saltSetup.ModemConnectAction {
+		case modemConnectActionPing:
+			s.modemPing()
+		case modemConnectActionCheckForUpdate:
+			s.runUpdateIfAvailable(saltrequester.TriggerModem)
+		case modemConnectActionNone:
+			continue
+		default:
+			log.Errorf("Unknown modem connect action '%s'", saltSetup.ModemConnectAction)
+			continue
+		}
+		lastAction = time.Now()
+	}
+}
+
+// modemPing pings the salt master after the modem has connected, recording the result in the
+// salt state so connectivity after a reconnect can be seen. With ping events on a salt-modem-ping
+// event is sent instead of a salt-ping event.
+func (s *saltUpdater) modemPing() {
+	args := []string{"test.ping"}
+	start := time.Now()
+	// The claim is held across the retries and recording the result so no other salt call can
+	// start in between.
+	if err := s.claimSaltCall(args, false); err != nil {
+		log.Printf("Salt ping after modem connected didn't run: %v", err)
+		return
+	}
+	defer s.releaseSaltCall()
+	// Failed attempts that are retried aren't recorded, only the final result is.
+	var result *saltCallResult
+	for attempt := 0; ; attempt++ {
+		var err error
+		result, err = s.runLockedSaltCommand(args)
+		if err != nil {
+			log.Printf("Salt ping after modem connected didn't run: %v", err)
+			return
+		}
+		// A ping doesn't output state results, so there is no JSON summary.
+		if callSucceeded(result.out, result.err, nil) || attempt >= modemPingRetries {
+			break
+		}
+		log.Printf("Salt ping after modem connected failed, retrying in %s (%d/%d)", modemPingRetryDelay, attempt+1, modemPingRetries)
+		time.Sleep(modemPingRetryDelay)
+	}
+	state, err := s.recordSaltCall(args, result, false, time.Now())
+	if err != nil {
+		log.Errorf("Failed to record salt ping after modem connected: %v", err)
+		return
+	}
+	success := state.LastCallSuccess
+	log.Printf("Salt ping after modem connected, success: %v", success)
+	s.state.LastModemPing = start
+	s.state.LastModemPingSuccess = success
+	if err := s.saveState(); err != nil {
+		log.Errorf("Failed to write salt state: %v", err)
+	}
+	if !pingEvents {
+		return
+	}
+	event := makePingEvent(*state, result.duration)
+	event.Type = eventType("salt-modem-ping")
+	if err := addEvent(event); err != nil {
+		log.Errorf("Failed to add salt modem ping event: %v", err)
 	}
 }
 
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/go-utils/logging"
 	saltrequester "github.com/TheCacophonyProject/salt-updater"
 	"github.com/stretchr/testify/assert"
 )
@@ -37,6 +46,16 @@ Failed:      1
 Total states run:     106
 Total run time:    10.457 s`
 
+const testOutNoChanges = `local:
+
+Summary for local
+--------------
+Succeeded: 106
+Failed:      0
+--------------
+Total states run:     106
+Total run time:    9.821 s`
+
 func TestMakeEvent(t *testing.T) {
 	minionID = "tc2-foobar"
 	args := []string{"arg1", "arg2"}
@@ -50,12 +69,13 @@ func TestMakeEvent(t *testing.T) {
 	})
 	assert.NoError(t, err)
 	assert.Equal(t, event.Details["changed"], float64(5))
+	assert.Equal(t, event.Details["hadChanges"], true)
 	assert.Equal(t, event.Details["succeeded"], float64(106))
 	assert.Equal(t, event.Details["failed"], float64(0))
 	assert.Equal(t, event.Details["nodegroup"], nodegroup)
 	assert.Equal(t, event.Details["args"], args)
 	assert.Equal(t, event.Details["out"], nil)
-	assert.Equal(t, event.Details["runTime"], nil)
+	assert.Equal(t, event.Details["runTime"], float64(10.457))
 	assert.Equal(t, event.Details["minionID"], "tc2-foobar")
 
 	event, err = makeEventFromState(saltrequester.SaltState{
@@ -66,6 +86,7 @@ func TestMakeEvent(t *testing.T) {
 	})
 	assert.NoError(t, err)
 	assert.Equal(t, event.Details["changed"], float64(5))
+	assert.Equal(t, event.Details["hadChanges"], true)
 	assert.Equal(t, event.Details["succeeded"], float64(106))
 	assert.Equal(t, event.Details["failed"], float64(1))
 	assert.Equal(t, event.Details["nodegroup"], nodegroup)
@@ -74,3 +95,811 @@ func TestMakeEvent(t *testing.T) {
 	assert.Equal(t, event.Details["runTime"], float64(10.457))
 	assert.Equal(t, event.Details["minionID"], "tc2-foobar")
 }
+
+const testOutFailedState = `local:
+Name: systemctl restart stay-on - Function: cmd.run - Result: Changed Started: - 15:14:07.884464 Duration: 79.173 ms
+----------
+          ID: install-foo
+    Function: pkg.installed
+        Name: foo
+      Result: False
+     Comment: The following packages failed to install/update:
+              foo
+     Started: 15:14:10.123456
+    Duration: 1203.5 ms
+     Changes:
+----------
+          ID: restart-bar
+    Function: service.running
+        Name: bar
+      Result: True
+     Comment: Service bar is already enabled, and is running
+     Started: 15:14:12.123456
+    Duration: 50.1 ms
+     Changes:
+Name: systemctl stop stay-on - Function: cmd.run - Result: Changed Started: - 15:14:19.832504 Duration: 75.117 ms
+
+Summary for local
+--------------
+Succeeded: 106 (changed=5)
+Failed:      1
+--------------
+Total states run:     107
+Total run time:    10.457 s`
+
+func TestEventsIncludeMinionID(t *testing.T) {
+	minionID = "tc2-foobar"
+	events := []eventclient.Event{
+		makePingEvent(saltrequester.SaltState{LastCallSuccess: true}, time.Second),
+		makeSkippedEvent("tc2-prod", time.Now()),
+		makeLowDiskSpaceEvent(&lowDiskSpaceError{path: "/", freeMB: 10, minFreeMB: 200}, "tc2-prod"),
+	}
+	for _, event := range events {
+		assert.Equal(t, "tc2-foobar", event.Details["minionID"], event.Type)
+	}
+}
+
+func TestMakeEventNoChanges(t *testing.T) {
+	event, err := makeEventFromState(saltrequester.SaltState{
+		LastCallSuccess: true,
+		LastCallOut:     testOutNoChanges,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, event.Details["changed"], float64(0))
+	assert.Equal(t, event.Details["hadChanges"], false)
+	assert.Equal(t, event.Details["succeeded"], float64(106))
+	assert.Equal(t, event.Details["success"], true)
+}
+
+func TestMakeEventFailedStates(t *testing.T) {
+	event, err := makeEventFromState(saltrequester.SaltState{
+		LastCallSuccess: false,
+		LastCallOut:     testOutFailedState,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []failedState{{
+		ID:       "install-foo",
+		Function: "pkg.installed",
+		Name:     "foo",
+		Result:   "False",
+		Comment:  "The following packages failed to install/update:\nfoo",
+		Duration: "1203.5 ms",
+	}}, event.Details["failedStates"])
+}
+
+func TestResetStartupState(t *testing.T) {
+	log = logging.NewLogger("info")
+	lastUpdate := time.Now()
+	state := &saltrequester.SaltState{
+		RunningUpdate:            true,
+		RunningArgs:              []string{"state.apply"},
+		UpdateProgressPercentage: 50,
+		UpdateProgressStr:        "some-state",
+		LastUpdate:               lastUpdate,
+	}
+	resetStartupState(state, false)
+	assert.False(t, state.RunningUpdate)
+	assert.Nil(t, state.RunningArgs)
+	assert.Equal(t, 0, state.UpdateProgressPercentage)
+	assert.Equal(t, "", state.UpdateProgressStr)
+	assert.Equal(t, lastUpdate, state.LastUpdate)
+}
+
+func TestResetStartupStateSaltCallRunning(t *testing.T) {
+	log = logging.NewLogger("info")
+	state := &saltrequester.SaltState{
+		RunningUpdate:            true,
+		RunningArgs:              []string{"state.apply"},
+		UpdateProgressPercentage: 50,
+		UpdateProgressStr:        "some-state",
+	}
+	resetStartupState(state, true)
+	assert.True(t, state.RunningUpdate)
+	assert.Equal(t, []string{"state.apply"}, state.RunningArgs)
+	assert.Equal(t, 0, state.UpdateProgressPercentage)
+	assert.Equal(t, "", state.UpdateProgressStr)
+}
+
+func TestParseFailedStatesMultiLineComment(t *testing.T) {
+	out := `local:
+----------
+          ID: install-foo
+    Function: cmd.run
+        Name: apt-get install -y foo
+      Result: False
+     Comment: Command "apt-get install -y foo" run
+              E: Unable to locate package foo
+              retcode: 100
+     Started: 15:14:10.123456
+    Duration: 1203.5 ms
+     Changes:
+`
+	assert.Equal(t, []failedState{{
+		ID:       "install-foo",
+		Function: "cmd.run",
+		Name:     "apt-get install -y foo",
+		Result:   "False",
+		Comment:  "Command \"apt-get install -y foo\" run\nE: Unable to locate package foo\nretcode: 100",
+		Duration: "1203.5 ms",
+	}}, parseFailedStates(out, nil))
+}
+
+func TestMakeEventTruncatesOut(t *testing.T) {
+	defer func(max int) { eventOutMaxBytes = max }(eventOutMaxBytes)
+	eventOutMaxBytes = 100
+
+	out := strings.Repeat("some long salt output\n", 100) + testOutFail
+	event, err := makeEventFromState(saltrequester.SaltState{
+		LastCallSuccess: true,
+		LastCallOut:     out,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, len(out), event.Details["outLength"])
+	eventOut := event.Details["out"].(string)
+	assert.Len(t, eventOut, 100)
+	assert.True(t, strings.HasSuffix(out, eventOut))
+	assert.Contains(t, eventOut, "Total run time:    10.457 s")
+}
+
+func TestUpdateCheckInterval(t *testing.T) {
+	assert.Equal(t, 24*time.Hour, updateCheckInterval(0))
+	assert.Equal(t, 30*time.Minute, updateCheckInterval(1))
+	assert.Equal(t, time.Hour, updateCheckInterval(2))
+	assert.Equal(t, 2*time.Hour, updateCheckInterval(3))
+	assert.Equal(t, 16*time.Hour, updateCheckInterval(6))
+	assert.Equal(t, 24*time.Hour, updateCheckInterval(7))
+	assert.Equal(t, 24*time.Hour, updateCheckInterval(100))
+}
+
+func TestCallSucceeded(t *testing.T) {
+	assert.True(t, callSucceeded([]byte(testOutSuccess), nil, nil))
+	assert.False(t, callSucceeded([]byte(testOutFail), nil, nil))
+	assert.False(t, callSucceeded([]byte(testOutSuccess), errors.New("exit status 1"), nil))
+	assert.True(t, callSucceeded([]byte("local:\n    True"), nil, nil))
+
+	// A failure is still found when the output has colour codes.
+	colorOutFail := "\x1b[0;36mSummary for local\x1b[0;0m\n" +
+		"\x1b[0;32mSucceeded: 105\x1b[0;0m (\x1b[0;32mchanged=1\x1b[0;0m)\n" +
+		"\x1b[0;31mFailed:     1\x1b[0;0m\n" +
+		"\x1b[0;36mTotal states run:     106\x1b[0;0m\n"
+	failed, ok := parseFailedCount(colorOutFail, nil)
+	assert.True(t, ok)
+	assert.Equal(t, 1, failed)
+	assert.False(t, callSucceeded([]byte(colorOutFail), nil, nil))
+	total, ok := parseTotalStatesRun(colorOutFail, nil)
+	assert.True(t, ok)
+	assert.Equal(t, 106, total)
+}
+
+func TestMakeSkippedEvent(t *testing.T) {
+	minionID = "tc2-foobar"
+	latestUpdateTime := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	event := makeSkippedEvent("tc2-prod", latestUpdateTime)
+	assert.Equal(t, "salt-update-skipped", event.Type)
+	assert.Equal(t, "tc2-prod", event.Details["nodegroup"])
+	assert.Equal(t, "2024-05-01T12:30:00Z", event.Details["latestUpdateTime"])
+	assert.Equal(t, "tc2-foobar", event.Details["minionID"])
+}
+
+const testOutTerseFail = `local:
+Name: systemctl restart stay-on - Function: cmd.run - Result: Changed Started: - 15:14:07.884464 Duration: 79.173 ms
+Name: foo - Function: pkg.installed - Result: Failed Started: - 15:14:10.123456 Duration: 1203.5 ms
+Name: bar - Function: service.running - Result: Clean Started: - 15:14:12.123456 Duration: 50.1 ms
+
+Summary for local
+--------------
+Succeeded: 105 (changed=1)
+Failed:      1
+--------------
+Total states run:     106
+Total run time:    10.457 s`
+
+func TestMakeEventTerse(t *testing.T) {
+	event, err := makeEventFromState(saltrequester.SaltState{
+		LastCallSuccess: false,
+		LastCallOut:     testOutTerseFail,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(105), event.Details["succeeded"])
+	assert.Equal(t, float64(1), event.Details["changed"])
+	assert.Equal(t, float64(1), event.Details["failed"])
+	assert.Equal(t, float64(10.457), event.Details["runTime"])
+	assert.Equal(t, []failedState{{
+		Name:     "foo",
+		Function: "pkg.installed",
+		Result:   "Failed",
+		Duration: "1203.5 ms",
+	}}, event.Details["failedStates"])
+}
+
+func TestTruncateHead(t *testing.T) {
+	assert.Equal(t, "hello", truncateHead("hello", 0))
+	assert.Equal(t, "hello", truncateHead("hello", 10))
+	assert.Equal(t, "llo", truncateHead("hello", 3))
+
+	// A multi-byte character isn't cut in half.
+	out := "temp: 20°C ✓"
+	for maxBytes := 1; maxBytes <= len(out); maxBytes++ {
+		truncated := truncateHead(out, maxBytes)
+		assert.True(t, utf8.ValidString(truncated), "maxBytes %d gave %q", maxBytes, truncated)
+		assert.LessOrEqual(t, len(truncated), maxBytes)
+		assert.True(t, strings.HasSuffix(out, truncated))
+	}
+	assert.Equal(t, "C ✓", truncateHead(out, 5))
+	assert.Equal(t, "C ✓", truncateHead(out, 6))
+	assert.Equal(t, "°C ✓", truncateHead(out, 7))
+}
+
+func TestTailLines(t *testing.T) {
+	out := "one\ntwo\nthree\n"
+	assert.Equal(t, "two\nthree", tailLines(out, 2))
+	assert.Equal(t, "one\ntwo\nthree", tailLines(out, 5))
+	assert.Equal(t, "one\ntwo\nthree", tailLines(out, 0))
+	assert.Equal(t, "", tailLines("", 3))
+}
+
+func TestValidateSaltCallArg(t *testing.T) {
+	assert.NoError(t, validateSaltCallArg("--log-level=debug"))
+	assert.NoError(t, validateSaltCallArg("--log-file-level=info"))
+	assert.NoError(t, validateSaltCallArg("--no-color"))
+	assert.Error(t, validateSaltCallArg("--log-level=loud"))
+	assert.Error(t, validateSaltCallArg("--log-level"))
+	assert.Error(t, validateSaltCallArg("--no-color=yes"))
+	// Colour is off when salt-call output isn't a terminal, forcing it on would change the parsed output.
+	assert.Error(t, validateSaltCallArg("--force-color"))
+	assert.Error(t, validateSaltCallArg("--state-output=full"))
+	assert.Error(t, validateSaltCallArg("--local"))
+	assert.Error(t, validateSaltCallArg("--file-root=/tmp"))
+}
+
+// fakeSaltRunner returns canned salt-call output instead of running salt.
+type fakeSaltRunner struct {
+	out  string
+	err  error
+	args []string
+}
+
+func (f *fakeSaltRunner) Run(args []string) ([]byte, []byte, error) {
+	f.args = args
+	return []byte(f.out), nil, f.err
+}
+
+func newTestSaltUpdater(t *testing.T, runner SaltRunner) (*saltUpdater, *[]eventclient.Event) {
+	log = logging.NewLogger("info")
+	saltrequester.SetStateFile(filepath.Join(t.TempDir(), "saltUpdate.json"))
+	saltCallLockFile = filepath.Join(t.TempDir(), "salt-helper.lock")
+	rebootRequiredFile = filepath.Join(t.TempDir(), "reboot-required")
+	historyFile = filepath.Join(t.TempDir(), "salt-update-history.json")
+	eventQueueFile = filepath.Join(t.TempDir(), "salt-helper-event-queue.json")
+	events := &[]eventclient.Event{}
+	addEvent = func(event eventclient.Event) error {
+		*events = append(*events, event)
+		return nil
+	}
+	t.Cleanup(func() { addEvent = eventclient.AddEvent })
+	modemPingRetryDelay = 0
+	t.Cleanup(func() {
+		modemPingRetryDelay = time.Duration(defaultSaltConfig().ModemPingRetryDelaySeconds) * time.Second
+	})
+	return &saltUpdater{state: &saltrequester.SaltState{}, runner: runner, skipDelay: make(chan struct{}, 1), reloaded: make(chan struct{}, 1)}, events
+}
+
+func TestRunSaltCallSyncUpdate(t *testing.T) {
+	runner := &fakeSaltRunner{out: testOutSuccess}
+	salt, events := newTestSaltUpdater(t, runner)
+	salt.state.ConsecutiveFailures = 2
+	salt.state.LastTrigger = saltrequester.TriggerManual
+	updateTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	state, err := salt.runSaltCallSync([]string{"state.apply"}, true, updateTime)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"state.apply"}, runner.args)
+	assert.False(t, state.RunningUpdate)
+	assert.True(t, state.LastCallSuccess)
+	assert.Equal(t, updateTime, state.LastUpdate)
+	assert.Equal(t, 0, state.ConsecutiveFailures)
+	assert.Equal(t, 10.457, state.LastRunTimeSeconds)
+
+	if assert.Len(t, *events, 1) {
+		assert.Equal(t, "salt-update", (*events)[0].Type)
+		assert.Equal(t, true, (*events)[0].Details["success"])
+		assert.Equal(t, "manual", (*events)[0].Details["trigger"])
+	}
+
+	saved, err := saltrequester.StateFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, updateTime, saved.LastUpdate)
+}
+
+func TestRunSaltCallSyncUpdateFailed(t *testing.T) {
+	salt, events := newTestSaltUpdater(t, &fakeSaltRunner{out: testOutFail, err: errors.New("exit status 1")})
+	lastUpdate := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	salt.state.LastUpdate = lastUpdate
+
+	state, err := salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, state.LastCallSuccess)
+	assert.Equal(t, lastUpdate, state.LastUpdate)
+	assert.Equal(t, 1, state.ConsecutiveFailures)
+	if assert.Len(t, *events, 1) {
+		assert.Equal(t, false, (*events)[0].Details["success"])
+	}
+}
+
+func TestRunSaltCallSyncPing(t *testing.T) {
+	salt, events := newTestSaltUpdater(t, &fakeSaltRunner{out: "local:\n    True"})
+
+	state, err := salt.runSaltCallSync([]string{"test.ping"}, false, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, state.LastCallSuccess)
+	assert.True(t, state.LastUpdate.IsZero())
+	assert.Empty(t, *events)
+}
+
+func TestSaveTotalStatesCount(t *testing.T) {
+	log = logging.NewLogger("info")
+	totalStatesCountFile = filepath.Join(t.TempDir(), "salt-states-count")
+	assert.Equal(t, 100, readTotalStatesCount(100))
+
+	saveTotalStatesCount(120)
+	assert.Equal(t, 120, readTotalStatesCount(100))
+
+	calibrateTotalStatesCount(saltrequester.SaltState{LastCallSuccess: true, LastCallOut: testOutSuccess})
+	assert.Equal(t, 106, readTotalStatesCount(100))
+
+	// A failed run doesn't replace the count from the last successful run.
+	calibrateTotalStatesCount(saltrequester.SaltState{LastCallSuccess: false, LastCallOut: testOutFailedState})
+	assert.Equal(t, 106, readTotalStatesCount(100))
+}
+
+func TestParseTotalStatesRun(t *testing.T) {
+	totalStates, ok := parseTotalStatesRun(testOutSuccess, nil)
+	assert.True(t, ok)
+	assert.Equal(t, 106, totalStates)
+
+	_, ok = parseTotalStatesRun("local:\n    True", nil)
+	assert.False(t, ok)
+}
+
+func TestAutoUpdatePaused(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{})
+	assert.False(t, salt.autoUpdatePaused())
+
+	assert.NoError(t, salt.pauseAutoUpdate(time.Hour))
+	assert.True(t, salt.autoUpdatePaused())
+
+	assert.NoError(t, salt.pauseAutoUpdate(0))
+	assert.False(t, salt.autoUpdatePaused())
+
+	// An expired pause is cleared.
+	salt.state.AutoUpdatePausedUntil = time.Now().Add(-time.Minute)
+	assert.False(t, salt.autoUpdatePaused())
+	assert.True(t, salt.state.AutoUpdatePausedUntil.IsZero())
+}
+
+func TestSetNextScheduledUpdate(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{})
+	next := time.Now().Add(updateCheckPeriod).Truncate(time.Second)
+	salt.setNextScheduledUpdate(next)
+
+	state, err := saltrequester.StateFromFile()
+	assert.NoError(t, err)
+	assert.True(t, next.Equal(state.NextScheduledUpdate))
+}
+
+func TestWaitForNextScheduledUpdate(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{})
+	checked := time.Now().Add(-updateCheckPeriod)
+	salt.waitForNextScheduledUpdate(checked)
+	assert.True(t, checked.Add(updateCheckPeriod).Equal(salt.state.NextScheduledUpdate))
+
+	// No update is scheduled while auto update is still paused at the next check.
+	assert.NoError(t, salt.pauseAutoUpdate(2*updateCheckPeriod))
+	salt.waitForNextScheduledUpdate(checked)
+	assert.True(t, salt.state.NextScheduledUpdate.IsZero())
+	next := time.Now().Add(updateCheckPeriod)
+	assert.True(t, salt.nextScheduledUpdate(next).IsZero())
+	assert.NoError(t, salt.pauseAutoUpdate(time.Hour))
+	assert.True(t, next.Equal(salt.nextScheduledUpdate(next)))
+
+	// A reload doesn't block when the loop isn't waiting, and wakes the next wait.
+	salt.wakeForReload()
+	salt.wakeForReload()
+	assert.False(t, sleepWithHeartbeatOrCancel(time.Hour, salt.reloaded))
+}
+
+func TestSetLastUpdate(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{})
+	salt.state.LastUpdateVersion = "v1.2.3"
+	salt.state.LastUpdateSHA = "abc123"
+	assert.Error(t, salt.setLastUpdate(time.Now().Add(time.Hour).Format(time.RFC3339), false))
+	assert.Equal(t, "abc123", salt.state.LastUpdateSHA)
+
+	lastUpdate := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, salt.setLastUpdate(lastUpdate.Format(time.RFC3339), false))
+	assert.True(t, lastUpdate.Equal(salt.state.LastUpdate))
+	// The update check compares the time, not the version or SHA of an earlier update.
+	assert.Empty(t, salt.state.LastUpdateVersion)
+	assert.Empty(t, salt.state.LastUpdateSHA)
+}
+
+func TestCheckForUpdateErrorClearsAvailable(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{})
+	salt.state.AvailableVersion = "v1.2.3"
+	salt.state.AvailableSHA = "abc123"
+	// There is no nodegroup file in the test, so the check fails.
+	_, _, err := salt.checkForUpdate()
+	assert.Error(t, err)
+	assert.Empty(t, salt.state.AvailableVersion)
+	assert.Empty(t, salt.state.AvailableSHA)
+}
+
+func TestUpdateExistsForBranchOverride(t *testing.T) {
+	newTestSaltUpdater(t, &fakeSaltRunner{})
+	versionInfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"prod": {"tc2": {"commitDate": "2024-05-01T12:00:00Z", "commitSHA": "def456"}}}`))
+	}))
+	defer versionInfo.Close()
+	commits := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sha": "abc123", "commit": {"committer": {"date": "2024-05-02T12:00:00Z"}}}`))
+	}))
+	defer commits.Close()
+	missingCommits := httptest.NewServer(http.NotFoundHandler())
+	defer missingCommits.Close()
+	defer func() {
+		saltrequester.VersionInfoURL = saltrequester.DefaultVersionInfoURL
+		saltrequester.CommitsURL = saltrequester.DefaultCommitsURL
+		saltrequester.ClearUpdateCache()
+	}()
+	saltrequester.VersionInfoURL = versionInfo.URL
+	saltrequester.CommitsURL = commits.URL + "/"
+
+	updateAvailable, info, err := updateExistsForBranchOverride("prod")
+	assert.NoError(t, err)
+	assert.True(t, updateAvailable)
+	assert.Equal(t, "def456", info.CommitSHA)
+
+	// A branch missing from the version info is checked as a ref.
+	updateAvailable, info, err = updateExistsForBranchOverride("prod-canary")
+	assert.NoError(t, err)
+	assert.True(t, updateAvailable)
+	assert.Equal(t, "abc123", info.CommitSHA)
+
+	// If the ref can't be found either the update is skipped.
+	saltrequester.CommitsURL = missingCommits.URL + "/"
+	_, _, err = updateExistsForBranchOverride("prod-canary")
+	assert.ErrorIs(t, err, saltrequester.ErrBranchNotFound)
+}
+
+func TestSkipRandomDelay(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{})
+	assert.False(t, salt.skipRandomDelay())
+
+	done := make(chan bool)
+	go func() {
+		done <- salt.sleepRandomDelay(time.Hour)
+	}()
+	assert.Eventually(t, salt.skipRandomDelay, time.Second, time.Millisecond)
+	assert.False(t, <-done)
+
+	// A skip from before a delay started doesn't cut the next delay short.
+	salt.skipDelay <- struct{}{}
+	assert.True(t, salt.sleepRandomDelay(time.Millisecond))
+}
+
+// enablePingEvents turns on ping events for the test.
+func enablePingEvents(t *testing.T) {
+	pingEvents = true
+	t.Cleanup(func() { pingEvents = defaultSaltConfig().PingEvents })
+}
+
+func TestModemPing(t *testing.T) {
+	salt, events := newTestSaltUpdater(t, &fakeSaltRunner{out: "local:\n    True"})
+	salt.modemPing()
+	assert.True(t, salt.state.LastModemPingSuccess)
+	assert.False(t, salt.state.LastModemPing.IsZero())
+	assert.False(t, salt.isRunning())
+	assert.Empty(t, *events)
+
+	// Only the salt-modem-ping event is sent, not a salt-ping event as well.
+	enablePingEvents(t)
+	salt.modemPing()
+	assert.Len(t, *events, 1)
+	assert.Equal(t, "salt-modem-ping", (*events)[0].Type)
+	assert.Equal(t, true, (*events)[0].Details["success"])
+
+	_, err := salt.runSaltCallSync([]string{"test.ping"}, false, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, *events, 2)
+	assert.Equal(t, "salt-ping", (*events)[1].Type)
+
+	salt, events = newTestSaltUpdater(t, &fakeSaltRunner{out: "Minion did not return. [No response]", err: errors.New("exit status 1")})
+	salt.modemPing()
+	assert.False(t, salt.state.LastModemPingSuccess)
+	assert.Equal(t, false, (*events)[0].Details["success"])
+}
+
+// pingSequenceRunner fails the first failures salt pings, then succeeds.
+type pingSequenceRunner struct {
+	failures int
+	calls    int
+	// recorded is set if an earlier ping was saved in the state file when a ping is run.
+	recorded bool
+}
+
+func (r *pingSequenceRunner) Run(args []string) ([]byte, []byte, error) {
+	if state, err := saltrequester.StateFromFile(); err == nil && state.LastCallArgs != nil {
+		r.recorded = true
+	}
+	r.calls++
+	if r.calls <= r.failures {
+		return []byte("Minion did not return. [No response]"), nil, errors.New("exit status 1")
+	}
+	return []byte("local:\n    True"), nil, nil
+}
+
+func TestModemPingRetry(t *testing.T) {
+	enablePingEvents(t)
+	runner := &pingSequenceRunner{failures: modemPingRetries}
+	salt, events := newTestSaltUpdater(t, runner)
+	salt.modemPing()
+	assert.Equal(t, modemPingRetries+1, runner.calls)
+	// Only the final result is recorded.
+	assert.False(t, runner.recorded)
+	assert.True(t, salt.state.LastModemPingSuccess)
+	assert.True(t, salt.state.LastCallSuccess)
+	assert.Len(t, *events, 1)
+	assert.Equal(t, true, (*events)[0].Details["success"])
+
+	runner = &pingSequenceRunner{failures: modemPingRetries + 1}
+	salt, events = newTestSaltUpdater(t, runner)
+	salt.modemPing()
+	assert.Equal(t, modemPingRetries+1, runner.calls)
+	assert.False(t, runner.recorded)
+	assert.False(t, salt.state.LastModemPingSuccess)
+	assert.Len(t, *events, 1)
+	assert.Equal(t, false, (*events)[0].Details["success"])
+}
+
+func TestPingRejectedWhileUpdateRunning(t *testing.T) {
+	runner := &fakeSaltRunner{out: "local:\n    True"}
+	salt, _ := newTestSaltUpdater(t, runner)
+	salt.state.RunningUpdate = true
+	salt.state.RunningArgs = []string{"state.apply"}
+
+	_, err := salt.runSaltCallSync([]string{"test.ping"}, false, time.Now())
+	assert.ErrorIs(t, err, errUpdateRunning)
+	assert.ErrorIs(t, salt.runSaltCall([]string{"test.ping"}, false, time.Now()), errUpdateRunning)
+	assert.Nil(t, runner.args)
+}
+
+func TestUpdateWaitsForPing(t *testing.T) {
+	runner := &fakeSaltRunner{out: testOutSuccess}
+	salt, _ := newTestSaltUpdater(t, runner)
+	assert.NoError(t, salt.claimSaltCall([]string{"test.ping"}, false))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		salt.releaseSaltCall()
+	}()
+
+	_, err := salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+	assert.NoError(t, err)
+	assert.Contains(t, runner.args, "state.apply")
+}
+
+func TestApplyLocalWhileRunning(t *testing.T) {
+	runner := &fakeSaltRunner{}
+	salt, _ := newTestSaltUpdater(t, runner)
+	assert.NoError(t, salt.claimUpdate())
+	salt.state.UpdateProgressPercentage = 40
+	salt.state.UpdateProgressStr = "Running"
+
+	assert.ErrorIs(t, salt.applyLocal(t.TempDir()), errUpdateRunning)
+	// The progress of the running update isn't touched.
+	assert.Equal(t, 40, salt.state.UpdateProgressPercentage)
+	assert.Equal(t, "Running", salt.state.UpdateProgressStr)
+	assert.Nil(t, runner.args)
+}
+
+func TestRunModule(t *testing.T) {
+	runner := &fakeSaltRunner{out: "local:\n    1 day, 2:03:04"}
+	salt, _ := newTestSaltUpdater(t, runner)
+	out, err := salt.runModule("status.uptime")
+	assert.NoError(t, err)
+	assert.Equal(t, "local:\n    1 day, 2:03:04", out)
+	assert.Contains(t, runner.args, "status.uptime")
+	// Not counted as an update.
+	assert.True(t, salt.state.LastAttempt.IsZero())
+
+	runner.args = nil
+	_, err = salt.runModule("cmd.run")
+	assert.Error(t, err)
+	assert.Nil(t, runner.args)
+}
+
+func TestRunUpdateIfAvailableWhilePaused(t *testing.T) {
+	runner := &fakeSaltRunner{}
+	salt, _ := newTestSaltUpdater(t, runner)
+	assert.NoError(t, salt.pauseAutoUpdate(time.Hour))
+	jobID, started := salt.runUpdateIfAvailable(saltrequester.TriggerManual)
+	assert.False(t, started)
+	job, ok := salt.jobStatus(jobID)
+	assert.True(t, ok)
+	assert.Equal(t, saltrequester.JobSkipped, job.State)
+	assert.Nil(t, runner.args)
+	// A skipped update releases the salt call.
+	assert.False(t, salt.isRunning())
+}
+
+func TestRunUpdateIfAvailableWhileRunning(t *testing.T) {
+	runner := &fakeSaltRunner{}
+	salt, _ := newTestSaltUpdater(t, runner)
+	assert.NoError(t, salt.claimUpdate())
+
+	jobID, started := salt.runUpdateIfAvailable(saltrequester.TriggerManual)
+	assert.False(t, started)
+	job, _ := salt.jobStatus(jobID)
+	assert.Equal(t, saltrequester.JobSkipped, job.State)
+	// A ping can't start while an update holds the salt call.
+	_, err := salt.runSaltCallSync([]string{"test.ping"}, false, time.Now())
+	assert.ErrorIs(t, err, errUpdateRunning)
+	assert.Nil(t, runner.args)
+}
+
+func TestSaltBranch(t *testing.T) {
+	saltSetup := defaultSaltConfig()
+	branch, err := saltSetup.saltBranch("tc2-prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "prod", branch)
+
+	saltSetup.BranchOverride = "prod-canary"
+	branch, err = saltSetup.saltBranch("tc2-prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "prod-canary", branch)
+}
+
+func TestNodegroupChanged(t *testing.T) {
+	assert.False(t, nodegroupChanged(&saltrequester.NodegroupInfo{FileNodegroup: "tc2-prod", GrainNodegroup: "tc2-prod", StateNodegroup: "tc2-prod"}))
+	assert.True(t, nodegroupChanged(&saltrequester.NodegroupInfo{FileNodegroup: "tc2-dev", GrainNodegroup: "tc2-prod", StateNodegroup: "tc2-prod"}))
+	assert.True(t, nodegroupChanged(&saltrequester.NodegroupInfo{FileNodegroup: "tc2-prod", GrainNodegroup: "tc2-dev", StateNodegroup: "tc2-prod"}))
+	assert.False(t, nodegroupChanged(&saltrequester.NodegroupInfo{FileNodegroup: "tc2-prod", StateNodegroup: "tc2-prod"}))
+	assert.False(t, nodegroupChanged(&saltrequester.NodegroupInfo{FileNodegroup: "tc2-prod", GrainNodegroup: "tc2-prod"}))
+}
+
+func TestStateJSONCache(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{out: "local:\n    True"})
+	first, err := salt.stateJSON()
+	assert.NoError(t, err)
+
+	// Without a change the cached JSON is returned.
+	salt.state.UpdateProgressStr = "not marked as changed"
+	cached, err := salt.stateJSON()
+	assert.NoError(t, err)
+	assert.Equal(t, first, cached)
+
+	_, err = salt.runSaltCallSync([]string{"test.ping"}, false, time.Now())
+	assert.NoError(t, err)
+	updated, err := salt.stateJSON()
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, updated)
+	assert.Contains(t, string(updated), "test.ping")
+}
+
+func TestMakePingEvent(t *testing.T) {
+	minionID = "tc2-foobar"
+	event := makePingEvent(saltrequester.SaltState{LastCallSuccess: false, LastCallNodegroup: "tc2-prod"}, 1500*time.Millisecond)
+	assert.Equal(t, "salt-ping", event.Type)
+	assert.Equal(t, false, event.Details["success"])
+	assert.Equal(t, int64(1500), event.Details["latencyMs"])
+	assert.Equal(t, "tc2-prod", event.Details["nodegroup"])
+	assert.Equal(t, "tc2-foobar", event.Details["minionID"])
+}
+
+func TestApplySaltConfig(t *testing.T) {
+	saltSetup := defaultSaltConfig()
+	defer func() {
+		defaultSetup := defaultSaltConfig()
+		applySaltConfig(&defaultSetup)
+	}()
+	saltSetup.EventOutMaxBytes = 1024
+	saltSetup.VersionInfoURL = "http://mirror.local/salt-version-info.json"
+	saltSetup.UpdateCheckIntervalHours = 6
+	applySaltConfig(&saltSetup)
+	assert.Equal(t, 1024, eventOutMaxBytes)
+	assert.Equal(t, "http://mirror.local/salt-version-info.json", saltrequester.VersionInfoURL)
+	assert.Equal(t, 6*time.Hour, updateCheckInterval(0))
+	assert.Equal(t, 4*time.Hour, updateCheckInterval(4))
+
+	// Removing a setting goes back to the default.
+	saltSetup.VersionInfoURL = ""
+	saltSetup.UpdateCheckIntervalHours = 0
+	applySaltConfig(&saltSetup)
+	assert.Equal(t, saltrequester.DefaultVersionInfoURL, saltrequester.VersionInfoURL)
+	assert.Equal(t, 24*time.Hour, updateCheckInterval(0))
+}
+
+func TestRunSaltCallSyncEventFailure(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{out: testOutSuccess})
+	addEvent = func(event eventclient.Event) error {
+		return errors.New("event-reporter is not running")
+	}
+
+	state, err := salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, state.LastCallSuccess)
+	assert.Equal(t, 0, state.ConsecutiveFailures)
+}
+
+func TestRepeatedFailureEvent(t *testing.T) {
+	salt, events := newTestSaltUpdater(t, &fakeSaltRunner{out: testOutFail, err: errors.New("exit status 1")})
+	repeatedFailures := func() int {
+		count := 0
+		for _, event := range *events {
+			if event.Type == "salt-update-repeated-failure" {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i := 1; i < repeatedFailureThreshold; i++ {
+		_, err := salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 0, repeatedFailures())
+
+	_, err := salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, repeatedFailureThreshold, salt.state.ConsecutiveFailures)
+	assert.Equal(t, 1, repeatedFailures())
+	last := (*events)[len(*events)-1]
+	assert.Equal(t, repeatedFailureThreshold, last.Details["consecutiveFailures"])
+
+	// Only sent once when the threshold is reached.
+	_, err = salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, repeatedFailures())
+}
+
+func TestEventTypeSuffix(t *testing.T) {
+	saltSetup := defaultSaltConfig()
+	defer func() {
+		defaultSetup := defaultSaltConfig()
+		applySaltConfig(&defaultSetup)
+	}()
+	saltSetup.EventTypeSuffix = "-prod"
+	applySaltConfig(&saltSetup)
+
+	salt, events := newTestSaltUpdater(t, &fakeSaltRunner{out: testOutSuccess})
+	_, err := salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, *events, 1)
+	assert.Equal(t, "salt-update-prod", (*events)[0].Type)
+
+	assert.Equal(t, "salt-ping-prod", makePingEvent(saltrequester.SaltState{}, time.Second).Type)
+	assert.Equal(t, "salt-update-skipped-prod", makeSkippedEvent("tc2-prod", time.Now()).Type)
+}
+
+func TestSaltCallGlobalArgsMasterless(t *testing.T) {
+	saltSetup := defaultSaltConfig()
+	saltSetup.SaltCallArgs = []string{"--log-level=debug"}
+	assert.Equal(t, []string{"--log-level=debug"}, saltSetup.saltCallGlobalArgs([]string{"state.apply"}))
+
+	saltSetup.Masterless = true
+	assert.Equal(t, []string{"--local", "--log-level=debug"}, saltSetup.saltCallGlobalArgs([]string{"test.ping"}))
+	// A local apply already has --local.
+	assert.Equal(t, []string{"--log-level=debug"}, saltSetup.saltCallGlobalArgs([]string{"--local", "state.apply"}))
+}
+
+func TestSaveStateTruncatesOut(t *testing.T) {
+	salt, _ := newTestSaltUpdater(t, &fakeSaltRunner{})
+	defer func(maxBytes int) { stateFileOutMaxBytes = maxBytes }(stateFileOutMaxBytes)
+	stateFileOutMaxBytes = 10
+	salt.state.LastCallOut = strings.Repeat("x", 100) + "Summary"
+
+	assert.NoError(t, salt.saveState())
+	saved, err := saltrequester.StateFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "xxxSummary", saved.LastCallOut)
+	assert.Len(t, salt.state.LastCallOut, 107)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	minionConfigFile  = "/etc/salt/minion"
+	minionConfigDir   = "/etc/salt/minion.d"
+	masterDialTimeout = 5 * time.Second
+)
+
+// Ports the salt master listens on, publish and return ports.
+var masterPorts = []string{"4505", "4506"}
+
+// readSaltMaster reads the salt master address from the minion config.
+// Files in minion.d override the main minion config file.
+func readSaltMaster() (string, error) {
+	files := []string{minionConfigFile}
+	confFiles, _ := filepath.Glob(filepath.Join(minionConfigDir, "*.conf"))
+	files = append(files, confFiles...)
+
+	master := ""
+	for _, file := range files {
+		m, err := readMasterFromFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if m != "" {
+			master = m
+		}
+	}
+	if master == "" {
+		return "", errors.New("no salt master found in minion config")
+	}
+	return master, nil
+}
+
+// readMasterFromFile reads the "master" key from a minion config file. If there
+// is a list of masters the first one is used.
+func readMasterFromFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	inMasterList := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") || trimmed == "" {
+			continue
+		}
+		if inMasterList {
+			if strings.HasPrefix(trimmed, "- ") {
+				return strings.TrimSpace(strings.TrimPrefix(trimmed, "- ")), nil
+			}
+			inMasterList = false
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found || key != "master" {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		if value == "" {
+			inMasterList = true
+			continue
+		}
+		return value, nil
+	}
+	return "", scanner.Err()
+}
+
+// checkMasterReachable dials the salt master ports and returns the longest time taken to connect.
+func checkMasterReachable() (bool, time.Duration, error) {
+	master, err := readSaltMaster()
+	if err != nil {
+		return false, 0, err
+	}
+	var latency time.Duration
+	for _, port := range masterPorts {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(master, port), masterDialTimeout)
+		if err != nil {
+			log.Printf("Salt master %s not reachable on port %s: %v", master, port, err)
+			return false, 0, nil
+		}
+		conn.Close()
+		latency = max(latency, time.Since(start))
+	}
+	return true, latency, nil
+}
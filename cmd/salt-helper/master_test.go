@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMasterFromFile(t *testing.T) {
+	dir := t.TempDir()
+
+	single := filepath.Join(dir, "single")
+	assert.NoError(t, os.WriteFile(single, []byte("# master: old\nid: foo\nmaster: salt.example.com\n"), 0644))
+	master, err := readMasterFromFile(single)
+	assert.NoError(t, err)
+	assert.Equal(t, "salt.example.com", master)
+
+	list := filepath.Join(dir, "list")
+	assert.NoError(t, os.WriteFile(list, []byte("master:\n  - salt1.example.com\n  - salt2.example.com\n"), 0644))
+	master, err = readMasterFromFile(list)
+	assert.NoError(t, err)
+	assert.Equal(t, "salt1.example.com", master)
+
+	none := filepath.Join(dir, "none")
+	assert.NoError(t, os.WriteFile(none, []byte("id: foo\n"), 0644))
+	master, err = readMasterFromFile(none)
+	assert.NoError(t, err)
+	assert.Equal(t, "", master)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TheCacophonyProject/go-utils/saltutil"
+)
+
+// getMinionID reads the salt minion ID, a var so tests can fail it.
+var getMinionID = saltutil.GetMinionID
+
+// minionIDRetryInterval is how long to wait between attempts to read the minion ID, a var so tests can change it.
+var minionIDRetryInterval = 2 * time.Second
+
+// minionIDTimeout is how long to keep trying to read the minion ID.
+const minionIDTimeout = 30 * time.Second
+
+// readMinionIDWithRetry reads the salt minion ID, retrying until the timeout so a slow or
+// briefly failing filesystem at boot doesn't stop the service starting.
+func readMinionIDWithRetry(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		id, err := getMinionID(log)
+		if err == nil {
+			return id, nil
+		}
+		if time.Now().Add(minionIDRetryInterval).After(deadline) {
+			return "", fmt.Errorf("failed to read minion ID after %d attempts: %w", attempt, err)
+		}
+		log.Printf("Failed to read minion ID (attempt %d), retrying in %s: %v", attempt, minionIDRetryInterval, err)
+		time.Sleep(minionIDRetryInterval)
+	}
+}
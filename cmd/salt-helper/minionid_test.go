@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/go-utils/saltutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMinionIDWithRetry(t *testing.T) {
+	log = logging.NewLogger("info")
+	minionIDRetryInterval = time.Millisecond
+	defer func() {
+		getMinionID = saltutil.GetMinionID
+		minionIDRetryInterval = 2 * time.Second
+	}()
+
+	attempts := 0
+	getMinionID = func(*logrus.Logger) (string, error) {
+		attempts++
+		if attempts < 3 {
+			return "", os.ErrNotExist
+		}
+		return "tc2-1234", nil
+	}
+	id, err := readMinionIDWithRetry(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "tc2-1234", id)
+	assert.Equal(t, 3, attempts)
+
+	getMinionID = func(*logrus.Logger) (string, error) {
+		return "", os.ErrNotExist
+	}
+	_, err = readMinionIDWithRetry(20 * time.Millisecond)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
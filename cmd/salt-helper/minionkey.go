@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Status of the minion key on the salt master.
+const (
+	minionKeyAccepted   = "accepted"
+	minionKeyPending    = "pending"
+	minionKeyRejected   = "rejected"
+	minionKeyNoResponse = "no-response"
+	minionKeyUnknown    = "unknown"
+	// minionKeyMasterless is used in masterless mode, where there is no salt master to accept the key.
+	minionKeyMasterless = "masterless"
+)
+
+// minionKeyAcceptedCheck pings the salt master to check if it has accepted the minion key.
+// The ping isn't recorded in the salt state as it is only used for the key status.
+func (s *saltUpdater) minionKeyAcceptedCheck() (bool, string, error) {
+	if loadSaltConfig().Masterless {
+		return true, minionKeyMasterless, nil
+	}
+	result, err := s.runUnrecordedSaltCall([]string{"test.ping"})
+	if err != nil {
+		return false, "", fmt.Errorf("can't check the minion key: %w", err)
+	}
+	status := parseMinionKeyStatus(string(result.out), result.err)
+	log.Printf("Minion key status: %s", status)
+	return status == minionKeyAccepted, status, nil
+}
+
+// parseMinionKeyStatus works out the status of the minion key from the output of a salt-call test.ping.
+func parseMinionKeyStatus(out string, err error) string {
+	switch {
+	case strings.Contains(out, "has rejected this minion's public key"):
+		return minionKeyRejected
+	case strings.Contains(out, "has the minion key been accepted"),
+		strings.Contains(out, "Minion failed to authenticate"),
+		strings.Contains(out, "pending acceptance"):
+		return minionKeyPending
+	case strings.Contains(out, "Minion did not return"):
+		return minionKeyNoResponse
+	case err == nil && strings.Contains(out, "True"):
+		return minionKeyAccepted
+	}
+	return minionKeyUnknown
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMinionKeyStatus(t *testing.T) {
+	exitErr := errors.New("exit status 2")
+	assert.Equal(t, minionKeyAccepted, parseMinionKeyStatus("local:\n    True\n", nil))
+	assert.Equal(t, minionKeyPending, parseMinionKeyStatus("[ERROR   ] Minion failed to authenticate with the master, has the minion key been accepted?", exitErr))
+	assert.Equal(t, minionKeyRejected, parseMinionKeyStatus("[CRITICAL] The Salt Master has rejected this minion's public key!", exitErr))
+	assert.Equal(t, minionKeyNoResponse, parseMinionKeyStatus("Minion did not return. [No response]", exitErr))
+	assert.Equal(t, minionKeyUnknown, parseMinionKeyStatus("", exitErr))
+}
+
+func TestMinionKeyAcceptedCheck(t *testing.T) {
+	runner := &fakeSaltRunner{out: "local:\n    True"}
+	salt, _ := newTestSaltUpdater(t, runner)
+	accepted, status, err := salt.minionKeyAcceptedCheck()
+	assert.NoError(t, err)
+	assert.True(t, accepted)
+	assert.Equal(t, minionKeyAccepted, status)
+	assert.Contains(t, runner.args, "test.ping")
+	assert.False(t, salt.isRunning())
+
+	// Not checked while an update is running.
+	runner.args = nil
+	assert.NoError(t, salt.claimUpdate())
+	_, _, err = salt.minionKeyAcceptedCheck()
+	assert.ErrorIs(t, err, errUpdateRunning)
+	assert.Nil(t, runner.args)
+}
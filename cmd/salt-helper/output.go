@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// colorCodeRe matches the ANSI colour codes salt adds to its output when colour is on.
+var colorCodeRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// stripColor removes ANSI colour codes from salt output so it can be parsed.
+func stripColor(out string) string {
+	return colorCodeRe.ReplaceAllString(out, "")
+}
+
+// parseRunTime finds the total run time in seconds from the summary of a salt call.
+// Returns 0 if the output has no run time.
+//
+// The output parsing helpers take the summary from parseSaltJSON so the output of a salt call is
+// only decoded once, the text output is parsed if jsonSummary is nil.
+func parseRunTime(out string, jsonSummary *saltJSONSummary) (float64, error) {
+	if jsonSummary != nil {
+		return jsonSummary.RunTimeSeconds, nil
+	}
+	for _, line := range strings.Split(stripColor(out), "\n") {
+		if strings.HasPrefix(line, "Total run time:") {
+			numbers := extractNumbers(line)
+			if len(numbers) != 1 {
+				return 0, errors.New("failed to parse output of salt update")
+			}
+			return numbers[0], nil
+		}
+	}
+	return 0, nil
+}
+
+// parseFailedCount finds the number of failed states from the summary of a salt call.
+// Returns false if the output has no failed count.
+func parseFailedCount(out string, jsonSummary *saltJSONSummary) (int, bool) {
+	if jsonSummary != nil {
+		return jsonSummary.Failed, true
+	}
+	for _, line := range strings.Split(stripColor(out), "\n") {
+		if strings.HasPrefix(line, "Failed:") {
+			numbers := extractNumbers(line)
+			if len(numbers) != 1 {
+				return 0, false
+			}
+			return int(numbers[0]), true
+		}
+	}
+	return 0, false
+}
+
+// parseTotalStatesRun finds the total number of states run from the summary of a salt call.
+// Returns false if the output has no total.
+func parseTotalStatesRun(out string, jsonSummary *saltJSONSummary) (int, bool) {
+	if jsonSummary != nil {
+		return jsonSummary.Total, true
+	}
+	for _, line := range strings.Split(stripColor(out), "\n") {
+		if strings.HasPrefix(line, "Total states run:") {
+			numbers := extractNumbers(line)
+			if len(numbers) != 1 {
+				return 0, false
+			}
+			return int(numbers[0]), true
+		}
+	}
+	return 0, false
+}
+
+// parseStateSummary finds the number of states by result from the summary of a salt update.
+// Returns nil if the output has no summary.
+func parseStateSummary(out string, jsonSummary *saltJSONSummary) (*saltrequester.StateSummary, error) {
+	if jsonSummary != nil {
+		return &saltrequester.StateSummary{
+			Succeeded: jsonSummary.Succeeded,
+			Changed:   jsonSummary.Changed,
+			Failed:    jsonSummary.Failed,
+			Total:     jsonSummary.Total,
+		}, nil
+	}
+	var summary *saltrequester.StateSummary
+	for _, line := range strings.Split(stripColor(out), "\n") {
+		if strings.HasPrefix(line, "Succeeded:") {
+			// Salt leaves out "(changed=N)" when nothing changed.
+			numbers := extractNumbers(line)
+			if len(numbers) != 1 && len(numbers) != 2 {
+				return nil, errors.New("failed to parse output of salt update")
+			}
+			if summary == nil {
+				summary = &saltrequester.StateSummary{}
+			}
+			summary.Succeeded = int(numbers[0])
+			if len(numbers) == 2 {
+				summary.Changed = int(numbers[1])
+			}
+		}
+		if strings.HasPrefix(line, "Failed:") {
+			numbers := extractNumbers(line)
+			if len(numbers) != 1 {
+				return nil, errors.New("failed to parse output of salt update")
+			}
+			if summary == nil {
+				summary = &saltrequester.StateSummary{}
+			}
+			summary.Failed = int(numbers[0])
+		}
+	}
+	if summary != nil {
+		summary.Total, _ = parseTotalStatesRun(out, nil)
+	}
+	return summary, nil
+}
+
+// callSucceeded checks if a salt call was successful. Salt doesn't always exit with an error
+// when a state fails, so the failed count in the output is also checked.
+func callSucceeded(out []byte, err error, jsonSummary *saltJSONSummary) bool {
+	if err != nil {
+		return false
+	}
+	failed, ok := parseFailedCount(string(out), jsonSummary)
+	return !ok || failed == 0
+}
+
+// truncateHead removes the start of the string so it is no longer than maxBytes. It doesn't
+// cut a multi-byte character in half, so the result can be a few bytes shorter.
+// A maxBytes of 0 or less means no limit.
+func truncateHead(str string, maxBytes int) string {
+	if maxBytes <= 0 || len(str) <= maxBytes {
+		return str
+	}
+	start := len(str) - maxBytes
+	for start < len(str) && !utf8.RuneStart(str[start]) {
+		start++
+	}
+	return str[start:]
+}
+
+// tailLines returns the last n lines of the string, ignoring a trailing newline.
+// An n of 0 or less returns the whole string.
+func tailLines(str string, n int) string {
+	str = strings.TrimSuffix(str, "\n")
+	if n <= 0 {
+		return str
+	}
+	lines := strings.Split(str, "\n")
+	if len(lines) <= n {
+		return str
+	}
+	return strings.Join(lines[len(lines)-n:], "\n")
+}
+
+// failedState holds the details of a salt state that failed to apply.
+type failedState struct {
+	ID       string `json:"id"`
+	Function string `json:"function"`
+	Name     string `json:"name"`
+	Result   string `json:"result"`
+	Comment  string `json:"comment"`
+	Duration string `json:"duration"`
+}
+
+// parseFailedStates finds the failed states in the output of a salt call.
+// With --state-output=mixed the failed states are printed as a full block like:
+//
+//	----------
+//	          ID: some-state
+//	    Function: cmd.run
+//	        Name: some-command
+//	      Result: False
+//	     Comment: Command "some-command" run
+//	     Started: 15:14:07.884464
+//	    Duration: 79.173 ms
+//	     Changes:
+//
+// With --state-output=terse, or for successful states with mixed, each state is on one line like:
+//
+//	Name: some-command - Function: cmd.run - Result: Failed Started: - 15:14:07.884464 Duration: 79.173 ms
+func parseFailedStates(out string, jsonSummary *saltJSONSummary) []failedState {
+	if jsonSummary != nil {
+		return jsonSummary.FailedStates
+	}
+	failedStates := []failedState{}
+	var current *failedState
+	lastKey := ""
+	// lastKeyColon is the column of the colon after the last key, the keys are right aligned.
+	lastKeyColon := 0
+	addCurrent := func() {
+		if current != nil && current.Result == "False" {
+			failedStates = append(failedStates, *current)
+		}
+		current = nil
+		lastKey = ""
+		lastKeyColon = 0
+	}
+
+	for _, line := range strings.Split(stripColor(out), "\n") {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		// Lines indented past the colon of the Comment key continue the comment, even if they
+		// have a colon in them.
+		if current != nil && lastKey == "Comment" && trimmed != "" && indent > lastKeyColon {
+			current.Comment += "\n" + trimmed
+			continue
+		}
+		if state, ok := parseTerseState(trimmed); ok {
+			addCurrent()
+			if state.Result == "Failed" {
+				failedStates = append(failedStates, state)
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "----------") || trimmed == "" {
+			addCurrent()
+			continue
+		}
+		key, value, found := strings.Cut(trimmed, ":")
+		if found && !strings.Contains(key, " ") {
+			value = strings.TrimSpace(value)
+			switch key {
+			case "ID":
+				addCurrent()
+				current = &failedState{ID: value}
+			case "Function", "Name", "Result", "Comment", "Duration":
+				if current == nil {
+					continue
+				}
+				setFailedStateField(current, key, value)
+			}
+			lastKey = key
+			lastKeyColon = indent + len(key)
+			continue
+		}
+		// Multi-line comments are indented under the Comment key.
+		if current != nil && lastKey == "Comment" {
+			current.Comment += "\n" + trimmed
+		}
+	}
+	addCurrent()
+	return failedStates
+}
+
+var terseStateRe = regexp.MustCompile(`^Name: (.*) - Function: (\S+) - Result: (\S+) Started: - \S+ Duration: (.*)$`)
+
+// parseTerseState parses a state from a single line of terse output.
+func parseTerseState(line string) (failedState, bool) {
+	matches := terseStateRe.FindStringSubmatch(line)
+	if len(matches) != 5 {
+		return failedState{}, false
+	}
+	return failedState{
+		Name:     matches[1],
+		Function: matches[2],
+		Result:   matches[3],
+		Duration: matches[4],
+	}, true
+}
+
+func setFailedStateField(state *failedState, key, value string) {
+	switch key {
+	case "Function":
+		state.Function = value
+	case "Name":
+		state.Name = value
+	case "Result":
+		state.Result = value
+	case "Comment":
+		state.Comment = value
+	case "Duration":
+		state.Duration = value
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// progressMilestones tracks which update progress percentages have had a progress event.
+type progressMilestones struct {
+	milestones  []int
+	next        int
+	minInterval time.Duration
+	lastSent    time.Time
+}
+
+func newProgressMilestones(milestones []int, minInterval time.Duration) *progressMilestones {
+	sorted := slices.Clone(milestones)
+	slices.Sort(sorted)
+	return &progressMilestones{milestones: sorted, minInterval: minInterval}
+}
+
+// reached returns the highest milestone passed by the percentage that hasn't been reached before.
+// If the last milestone event was less than minInterval ago false is returned, so a quick run
+// through many milestones doesn't flood the event-reporter.
+func (p *progressMilestones) reached(percentage int, now time.Time) (int, bool) {
+	milestone := -1
+	for p.next < len(p.milestones) && percentage >= p.milestones[p.next] {
+		milestone = p.milestones[p.next]
+		p.next++
+	}
+	if milestone < 0 {
+		return 0, false
+	}
+	if !p.lastSent.IsZero() && now.Sub(p.lastSent) < p.minInterval {
+		return 0, false
+	}
+	p.lastSent = now
+	return milestone, true
+}
+
+// sendProgressEvent sends a salt-update-progress event for a milestone in an update.
+func sendProgressEvent(milestone, percentage int, state string) {
+	nodegroup, err := saltrequester.ReadNodegroup()
+	if err != nil {
+		log.Errorf("Failed to read nodegroup file: %v", err)
+	}
+	event := eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      eventType("salt-update-progress"),
+		Details: map[string]interface{}{
+			"milestone":  milestone,
+			"percentage": percentage,
+			"state":      state,
+			"nodegroup":  nodegroup,
+			"minionID":   minionID,
+		},
+	}
+	if err := addEvent(event); err != nil {
+		log.Errorf("Failed to add salt update progress event: %v", err)
+	}
+}
+
+// stateTimer times each state in an update from the time it starts to when the next one starts.
+type stateTimer struct {
+	current        string
+	start          time.Time
+	slowest        string
+	slowestSeconds float64
+}
+
+// next records that a new state started, logging how long the previous state took.
+func (t *stateTimer) next(state string, now time.Time) {
+	t.finish(now)
+	t.current = state
+	t.start = now
+}
+
+// finish records that the current state has finished.
+func (t *stateTimer) finish(now time.Time) {
+	if t.current == "" {
+		return
+	}
+	seconds := now.Sub(t.start).Seconds()
+	log.Printf("State %s took %.3fs", t.current, seconds)
+	if seconds > t.slowestSeconds {
+		t.slowest = t.current
+		t.slowestSeconds = seconds
+	}
+	t.current = ""
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressMilestones(t *testing.T) {
+	now := time.Now()
+	p := newProgressMilestones([]int{75, 25, 50}, time.Minute)
+
+	_, ok := p.reached(10, now)
+	assert.False(t, ok)
+
+	milestone, ok := p.reached(30, now)
+	assert.True(t, ok)
+	assert.Equal(t, 25, milestone)
+
+	// A milestone is only reported once.
+	_, ok = p.reached(40, now.Add(2*time.Minute))
+	assert.False(t, ok)
+
+	// Milestones reached too soon after the last event are skipped.
+	_, ok = p.reached(55, now.Add(30*time.Second))
+	assert.False(t, ok)
+
+	milestone, ok = p.reached(80, now.Add(2*time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, 75, milestone)
+}
+
+func TestStateTimer(t *testing.T) {
+	log = logging.NewLogger("info")
+	start := time.Now()
+	timer := &stateTimer{}
+	timer.next("pkg.installed", start)
+	timer.next("cmd.run", start.Add(2*time.Second))
+	timer.next("file.managed", start.Add(10*time.Second))
+	timer.finish(start.Add(11 * time.Second))
+
+	assert.Equal(t, "cmd.run", timer.slowest)
+	assert.Equal(t, 8.0, timer.slowestSeconds)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// rebootRequiredFile is written by packages that need a reboot to finish installing, salt states
+// can also write it. A var so tests can change it.
+var rebootRequiredFile = "/run/reboot-required"
+
+// procStatFile has the boot time of the system, a var so tests can change it.
+var procStatFile = "/proc/stat"
+
+// rebootStateRe matches a system.reboot state in the text or JSON output of a salt call.
+var rebootStateRe = regexp.MustCompile(`Function: system\.reboot\b|"system_\|-[^"]*_\|-reboot"`)
+
+// updateNeedsReboot checks if an update needs a reboot to finish, from the reboot required file
+// or a system.reboot state in the output.
+func updateNeedsReboot(out string) bool {
+	if _, err := os.Stat(rebootRequiredFile); err == nil {
+		return true
+	}
+	return rebootStateRe.MatchString(out)
+}
+
+// bootTime reads when the system booted.
+func bootTime() (time.Time, error) {
+	file, err := os.Open(procStatFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "btime "); found {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, errors.New("no boot time in " + procStatFile)
+}
+
+// checkRebootedForUpdate records if the device has rebooted since an update that needed a reboot,
+// or since an update that was still running when the state was saved, e.g. when a salt state
+// rebooted the device. This is checked on start before the stale running state is cleared.
+func checkRebootedForUpdate(saltState *saltrequester.SaltState, booted time.Time) {
+	if !saltState.RebootPending && !saltState.RunningUpdate {
+		return
+	}
+	if saltState.LastAttempt.IsZero() || !booted.After(saltState.LastAttempt) {
+		return
+	}
+	if saltState.RunningUpdate {
+		log.Printf("Device rebooted during the salt call %v", saltState.RunningArgs)
+	} else {
+		log.Println("Device rebooted to finish the last update")
+	}
+	saltState.RebootPending = false
+	saltState.RebootedForUpdate = true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateNeedsReboot(t *testing.T) {
+	rebootRequiredFile = filepath.Join(t.TempDir(), "reboot-required")
+	defer func() { rebootRequiredFile = "/run/reboot-required" }()
+
+	assert.False(t, updateNeedsReboot(testOutSuccess))
+	assert.False(t, updateNeedsReboot(testOutJSON))
+	assert.True(t, updateNeedsReboot("  Name: system.reboot - Function: system.reboot - Result: Changed Started: - 15:14:19.832504 Duration: 75.117 ms"))
+	assert.True(t, updateNeedsReboot(`{"local": {"system_|-reboot-for-kernel_|-reboot-for-kernel_|-reboot": {"result": true}}}`))
+
+	assert.NoError(t, os.WriteFile(rebootRequiredFile, []byte("*** System restart required ***\n"), 0644))
+	assert.True(t, updateNeedsReboot(testOutSuccess))
+}
+
+func TestBootTime(t *testing.T) {
+	procStatFile = filepath.Join(t.TempDir(), "stat")
+	defer func() { procStatFile = "/proc/stat" }()
+	stat := "cpu  2255 34 2290 22625563 6290 127 456 0 0 0\nintr 114930548 113199788 3 0 5\nbtime 1760572800\nprocesses 26442\n"
+	assert.NoError(t, os.WriteFile(procStatFile, []byte(stat), 0644))
+
+	booted, err := bootTime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1760572800, 0), booted)
+}
+
+func TestCheckRebootedForUpdate(t *testing.T) {
+	lastAttempt := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	// Booted before the update so still pending.
+	state := &saltrequester.SaltState{LastAttempt: lastAttempt, RebootPending: true}
+	checkRebootedForUpdate(state, lastAttempt.Add(-time.Hour))
+	assert.True(t, state.RebootPending)
+	assert.False(t, state.RebootedForUpdate)
+
+	checkRebootedForUpdate(state, lastAttempt.Add(time.Hour))
+	assert.False(t, state.RebootPending)
+	assert.True(t, state.RebootedForUpdate)
+
+	// Rebooted during an update.
+	state = &saltrequester.SaltState{LastAttempt: lastAttempt, RunningUpdate: true, RunningArgs: []string{"state.apply"}}
+	checkRebootedForUpdate(state, lastAttempt.Add(time.Minute))
+	assert.True(t, state.RebootedForUpdate)
+
+	// No update needing a reboot.
+	state = &saltrequester.SaltState{LastAttempt: lastAttempt}
+	checkRebootedForUpdate(state, lastAttempt.Add(time.Hour))
+	assert.False(t, state.RebootedForUpdate)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strconv"
+)
+
+// SaltRunner runs salt-call with the given args.
+type SaltRunner interface {
+	Run(args []string) (stdout, stderr []byte, err error)
+}
+
+// execSaltRunner runs the salt-call command on the device.
+type execSaltRunner struct{}
+
+func (execSaltRunner) Run(args []string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	command := saltCallCommand(args)
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// saltCallNice and saltCallLowIOPriority lower the priority of salt calls so they don't
+// take CPU and disk time from the camera, see saltCallCommand.
+var (
+	saltCallNice          = defaultSaltConfig().SaltCallNice
+	saltCallLowIOPriority = defaultSaltConfig().SaltCallLowIOPriority
+)
+
+// saltCallCommand returns the command that runs salt-call with the args, wrapped with nice and
+// ionice when salt calls run at a lower priority.
+func saltCallCommand(args []string) []string {
+	command := []string{}
+	if saltCallLowIOPriority {
+		// The lowest best-effort priority, the idle class could stop an update ever finishing on a busy disk.
+		command = append(command, "ionice", "-c", "2", "-n", "7")
+	}
+	if saltCallNice > 0 {
+		command = append(command, "nice", "-n", strconv.Itoa(min(saltCallNice, 19)))
+	}
+	command = append(command, "salt-call")
+	return append(command, args...)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaltCallCommand(t *testing.T) {
+	defer func() {
+		defaultSetup := defaultSaltConfig()
+		applySaltConfig(&defaultSetup)
+	}()
+	args := []string{"state.apply"}
+	assert.Equal(t, []string{"salt-call", "state.apply"}, saltCallCommand(args))
+
+	saltCallNice = 10
+	assert.Equal(t, []string{"nice", "-n", "10", "salt-call", "state.apply"}, saltCallCommand(args))
+
+	saltCallNice = 25
+	saltCallLowIOPriority = true
+	assert.Equal(t, []string{"ionice", "-c", "2", "-n", "7", "nice", "-n", "19", "salt-call", "state.apply"}, saltCallCommand(args))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// allowedSaltFunctions are the salt functions salt-helper can call.
+var allowedSaltFunctions = []string{"state.apply", "test.ping"}
+
+// allowedSaltOptions are the salt-call options salt-helper can use, options that take a
+// value are listed with the "=".
+var allowedSaltOptions = []string{"--local", "--file-root=", "--state-output=", "--output-diff", "--out="}
+
+// allowedSaltKwargs are the keyword arguments that can be passed to a salt function.
+var allowedSaltKwargs = []string{"saltenv"}
+
+// validateSaltCallArgs checks the args for a salt call only use allowed options, one allowed
+// salt function and allowed keyword arguments. This is checked before every salt call so
+// args from dbus can't be used to run other salt functions. The modules are the extra salt
+// functions allowed from the module whitelist config, see runModule.
+func validateSaltCallArgs(args []string, modules []string) error {
+	function := ""
+	for _, arg := range args {
+		if arg == "" {
+			return errors.New("empty salt-call arg")
+		}
+		if strings.ContainsAny(arg, "\x00\n\r;|&`$<>") {
+			return fmt.Errorf("salt-call arg '%s' has invalid characters", arg)
+		}
+		switch {
+		case strings.HasPrefix(arg, "-"):
+			if !isAllowedSaltOption(arg) {
+				return fmt.Errorf("salt-call option '%s' is not allowed", arg)
+			}
+		case function == "":
+			if !slices.Contains(allowedSaltFunctions, arg) && !slices.Contains(modules, arg) {
+				return fmt.Errorf("salt function '%s' is not allowed", arg)
+			}
+			function = arg
+		default:
+			key, _, found := strings.Cut(arg, "=")
+			if !found || !slices.Contains(allowedSaltKwargs, key) {
+				return fmt.Errorf("salt-call arg '%s' is not allowed", arg)
+			}
+		}
+	}
+	if function == "" {
+		return errors.New("no salt function in salt-call args")
+	}
+	return nil
+}
+
+func isAllowedSaltOption(arg string) bool {
+	for _, option := range allowedSaltOptions {
+		if strings.HasSuffix(option, "=") {
+			if strings.HasPrefix(arg, option) && len(arg) > len(option) {
+				return true
+			}
+		} else if arg == option {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSaltCallArgs(t *testing.T) {
+	valid := [][]string{
+		{"test.ping"},
+		{"state.apply", "--state-output=mixed", "--output-diff"},
+		{"state.apply", "saltenv=dev"},
+		{"--local", "--file-root=/home/pi/saltops", "state.apply", "--state-output=terse"},
+	}
+	for _, args := range valid {
+		assert.NoError(t, validateSaltCallArgs(args, nil), "%v", args)
+	}
+
+	invalid := [][]string{
+		{},
+		{""},
+		{"cmd.run", "rm -rf /"},
+		{"state.apply", "test.ping"},
+		{"state.apply", "pillar={}"},
+		{"state.apply", "saltenv=dev; reboot"},
+		{"state.apply", "saltenv=$(reboot)"},
+		{"--file-root=", "state.apply"},
+		{"--config-dir=/tmp", "state.apply"},
+		{"--local"},
+	}
+	for _, args := range invalid {
+		assert.Error(t, validateSaltCallArgs(args, nil), "%v", args)
+	}
+
+	modules := []string{"disk.usage"}
+	assert.NoError(t, validateSaltCallArgs([]string{"disk.usage"}, modules))
+	assert.Error(t, validateSaltCallArgs([]string{"disk.usage"}, nil))
+	assert.Error(t, validateSaltCallArgs([]string{"status.uptime"}, modules))
+}
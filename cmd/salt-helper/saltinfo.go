@@ -0,0 +1,30 @@
+package main
+
+import (
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// saltInfo returns the salt minion version, salt master address and minion ID.
+// The info is cached as it only changes when salt is reconfigured, refresh reads it again.
+func (s *saltUpdater) saltInfo(refresh bool) (*saltrequester.MinionInfo, error) {
+	s.minionInfoMu.Lock()
+	defer s.minionInfoMu.Unlock()
+	if s.minionInfo != nil && !refresh {
+		return s.minionInfo, nil
+	}
+
+	version, err := getSaltVersion()
+	if err != nil {
+		return nil, err
+	}
+	master, err := readSaltMaster()
+	if err != nil {
+		return nil, err
+	}
+	s.minionInfo = &saltrequester.MinionInfo{
+		MinionVersion: version,
+		MasterAddress: master,
+		MinionID:      minionID,
+	}
+	return s.minionInfo, nil
+}
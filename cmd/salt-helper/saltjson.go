@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// saltJSONState is the result of a state from salt-call --out=json.
+type saltJSONState struct {
+	ID       string                 `json:"__id__"`
+	Name     string                 `json:"name"`
+	Result   *bool                  `json:"result"`
+	Comment  interface{}            `json:"comment"`
+	Duration float64                `json:"duration"`
+	Changes  map[string]interface{} `json:"changes"`
+	RunNum   int                    `json:"__run_num__"`
+}
+
+// saltJSONSummary is the summary of a salt call parsed from its JSON output.
+type saltJSONSummary struct {
+	Succeeded      int
+	Changed        int
+	Failed         int
+	Total          int
+	RunTimeSeconds float64
+	FailedStates   []failedState
+	Changes        []saltrequester.ChangeItem
+}
+
+// parseSaltJSON parses the output of a salt-call state.apply run with --out=json, returning false
+// if the output isn't JSON state results so the text output parsing can be used instead.
+// The output looks like:
+//
+//	{"local": {"cmd_|-some-state_|-some-command_|-run": {"result": true, "duration": 79.173, ...}}}
+//
+// If salt fails before running the states, e.g. from a rendering error, the minion has a list of errors.
+// Only the first JSON value is parsed as salt-call logs can be after it in the output.
+func parseSaltJSON(out string) (*saltJSONSummary, bool) {
+	var minions map[string]json.RawMessage
+	if err := json.NewDecoder(strings.NewReader(out)).Decode(&minions); err != nil || len(minions) != 1 {
+		return nil, false
+	}
+	var result json.RawMessage
+	for _, r := range minions {
+		result = r
+	}
+
+	summary := &saltJSONSummary{FailedStates: []failedState{}, Changes: []saltrequester.ChangeItem{}}
+	var errs []string
+	if err := json.Unmarshal(result, &errs); err == nil {
+		for _, e := range errs {
+			summary.FailedStates = append(summary.FailedStates, failedState{Result: "False", Comment: e})
+		}
+		summary.Failed = len(errs)
+		summary.Total = len(errs)
+		return summary, true
+	}
+
+	var states map[string]saltJSONState
+	if err := json.Unmarshal(result, &states); err != nil {
+		return nil, false
+	}
+	// Sort by run order so failed states are in the order they ran.
+	keys := make([]string, 0, len(states))
+	for key := range states {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return states[keys[i]].RunNum < states[keys[j]].RunNum })
+
+	var durationMs float64
+	for _, key := range keys {
+		state := states[key]
+		summary.Total++
+		durationMs += state.Duration
+		if state.Result != nil && !*state.Result {
+			summary.Failed++
+			summary.FailedStates = append(summary.FailedStates, failedState{
+				ID:       state.ID,
+				Function: stateFunction(key),
+				Name:     state.Name,
+				Result:   "False",
+				Comment:  commentString(state.Comment),
+				Duration: fmt.Sprintf("%.3f ms", state.Duration),
+			})
+			continue
+		}
+		summary.Succeeded++
+		if len(state.Changes) > 0 {
+			summary.Changed++
+			summary.Changes = append(summary.Changes, saltrequester.ChangeItem{
+				ID:       state.ID,
+				Function: stateFunction(key),
+				Name:     state.Name,
+				Diff:     changesString(state.Changes),
+			})
+		}
+	}
+	summary.RunTimeSeconds = durationMs / 1000
+	return summary, true
+}
+
+// stateFunction gets the state function from a state key, e.g. "cmd.run" from "cmd_|-id_|-name_|-run".
+func stateFunction(key string) string {
+	parts := strings.Split(key, "_|-")
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[0] + "." + parts[3]
+}
+
+// changesString converts the changes of a state to a string, the diff if there is one.
+func changesString(changes map[string]interface{}) string {
+	if diff, ok := changes["diff"].(string); ok {
+		return diff
+	}
+	changesJSON, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return fmt.Sprint(changes)
+	}
+	return string(changesJSON)
+}
+
+// commentString converts a state comment, which can be a string or a list of strings, to a string.
+func commentString(comment interface{}) string {
+	switch c := comment.(type) {
+	case string:
+		return c
+	case []interface{}:
+		lines := make([]string, len(c))
+		for i, line := range c {
+			lines[i] = fmt.Sprint(line)
+		}
+		return strings.Join(lines, "\n")
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(comment)
+}
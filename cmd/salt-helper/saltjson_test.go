@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+	"github.com/stretchr/testify/assert"
+)
+
+const testOutJSON = `{
+    "local": {
+        "cmd_|-restart-stay-on_|-systemctl restart stay-on_|-run": {
+            "name": "systemctl restart stay-on",
+            "changes": {
+                "pid": 1234,
+                "retcode": 0,
+                "stderr": "",
+                "stdout": ""
+            },
+            "result": true,
+            "comment": "Command \"systemctl restart stay-on\" run",
+            "__sls__": "pi/stay-on",
+            "__run_num__": 0,
+            "start_time": "15:14:07.884464",
+            "duration": 79.173,
+            "__id__": "restart-stay-on"
+        },
+        "pkg_|-audiobait_|-audiobait_|-installed": {
+            "name": "audiobait",
+            "changes": {},
+            "result": false,
+            "comment": "An error was encountered while installing package(s): E: Unable to locate package audiobait",
+            "__sls__": "pi/audiobait",
+            "__run_num__": 2,
+            "start_time": "15:14:10.120312",
+            "duration": 2410.5,
+            "__id__": "audiobait"
+        },
+        "file_|-/etc/cacophony/config.toml_|-/etc/cacophony/config.toml_|-managed": {
+            "name": "/etc/cacophony/config.toml",
+            "changes": {},
+            "result": true,
+            "comment": "File /etc/cacophony/config.toml is in the correct state",
+            "__sls__": "pi/config",
+            "__run_num__": 1,
+            "start_time": "15:14:08.001311",
+            "duration": 10.327,
+            "__id__": "/etc/cacophony/config.toml"
+        }
+    }
+}
+[WARNING ] Some log line after the output`
+
+const testOutJSONRenderError = `{
+    "local": [
+        "Rendering SLS 'base:pi/audiobait' failed: Jinja variable 'dict object' has no attribute 'audiobait'"
+    ]
+}`
+
+func TestParseSaltJSON(t *testing.T) {
+	summary, ok := parseSaltJSON(testOutJSON)
+	assert.True(t, ok)
+	assert.Equal(t, 3, summary.Total)
+	assert.Equal(t, 2, summary.Succeeded)
+	assert.Equal(t, 1, summary.Changed)
+	assert.Equal(t, 1, summary.Failed)
+	assert.InDelta(t, 2.5, summary.RunTimeSeconds, 0.001)
+	assert.Equal(t, []failedState{{
+		ID:       "audiobait",
+		Function: "pkg.installed",
+		Name:     "audiobait",
+		Result:   "False",
+		Comment:  "An error was encountered while installing package(s): E: Unable to locate package audiobait",
+		Duration: "2410.500 ms",
+	}}, summary.FailedStates)
+
+	summary, ok = parseSaltJSON(testOutJSONRenderError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Contains(t, summary.FailedStates[0].Comment, "Rendering SLS")
+
+	_, ok = parseSaltJSON(testOutSuccess)
+	assert.False(t, ok)
+	_, ok = parseSaltJSON(`{"local": true}`)
+	assert.False(t, ok)
+}
+
+func TestMakeEventFromJSONState(t *testing.T) {
+	event, err := makeEventFromState(saltrequester.SaltState{LastCallOut: testOutJSON, LastCallSuccess: false})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), event.Details["succeeded"])
+	assert.Equal(t, float64(1), event.Details["changed"])
+	assert.Equal(t, float64(1), event.Details["failed"])
+	assert.InDelta(t, 2.5, event.Details["runTime"], 0.001)
+}
+
+func TestTruncatedJSONUsesSavedSummary(t *testing.T) {
+	salt, events := newTestSaltUpdater(t, &fakeSaltRunner{out: testOutJSON})
+	defer func(maxBytes int) { lastCallOutMaxBytes = maxBytes }(lastCallOutMaxBytes)
+	lastCallOutMaxBytes = 200
+
+	state, err := salt.runSaltCallSync([]string{"state.apply"}, true, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, state.LastCallOut, 200)
+	assert.Equal(t, &saltrequester.StateSummary{Succeeded: 2, Changed: 1, Failed: 1, Total: 3}, state.LastCallSummary)
+	assert.Equal(t, float64(1), (*events)[0].Details["failed"])
+
+	// The truncated output is no longer JSON, the saved summary is used instead, e.g. by resend-event.
+	event, err := makeEventFromState(*state)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), event.Details["succeeded"])
+	assert.Equal(t, float64(1), event.Details["changed"])
+	assert.Equal(t, float64(1), event.Details["failed"])
+	assert.InDelta(t, 2.5, event.Details["runTime"], 0.001)
+	assert.Equal(t, 1, makeUpdateRecord(*state).FailedStates)
+
+	// A call that isn't an update has no summary.
+	salt.runner = &fakeSaltRunner{out: "local:\n    True"}
+	state, err = salt.runSaltCallSync([]string{"test.ping"}, false, time.Now())
+	assert.NoError(t, err)
+	assert.Nil(t, state.LastCallSummary)
+}
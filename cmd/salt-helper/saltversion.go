@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var saltVersionRe = regexp.MustCompile(`salt-call\s+(\d+(?:\.\d+)*)`)
+
+// getSaltVersion gets the version of the installed salt minion from `salt-call --version`.
+func getSaltVersion() (string, error) {
+	out, err := exec.Command("salt-call", "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get salt version: %v, %s", err, string(out))
+	}
+	return parseSaltVersion(string(out))
+}
+
+// parseSaltVersion parses the version from the output of `salt-call --version`, e.g. "salt-call 3006.1 (Sulfur)".
+func parseSaltVersion(out string) (string, error) {
+	matches := saltVersionRe.FindStringSubmatch(out)
+	if len(matches) != 2 {
+		return "", fmt.Errorf("failed to parse salt version from '%s'", strings.TrimSpace(out))
+	}
+	return matches[1], nil
+}
+
+// compareSaltVersions returns -1 if a is older than b, 1 if a is newer than b, or 0 if they are the same.
+func compareSaltVersions(a, b string) (int, error) {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aNum, err := versionPart(aParts, i)
+		if err != nil {
+			return 0, fmt.Errorf("invalid salt version '%s': %v", a, err)
+		}
+		bNum, err := versionPart(bParts, i)
+		if err != nil {
+			return 0, fmt.Errorf("invalid salt version '%s': %v", b, err)
+		}
+		if aNum < bNum {
+			return -1, nil
+		}
+		if aNum > bNum {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func versionPart(parts []string, i int) (int, error) {
+	if i >= len(parts) {
+		return 0, nil
+	}
+	return strconv.Atoi(parts[i])
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSaltVersion(t *testing.T) {
+	version, err := parseSaltVersion("salt-call 3006.1 (Sulfur)\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "3006.1", version)
+
+	_, err = parseSaltVersion("command not found")
+	assert.Error(t, err)
+}
+
+func TestCompareSaltVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"3006.1", "3006.1", 0},
+		{"3006", "3006.0", 0},
+		{"3005.5", "3006.1", -1},
+		{"3006.10", "3006.9", 1},
+	}
+	for _, c := range cases {
+		got, err := compareSaltVersions(c.a, c.b)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, got, "%s vs %s", c.a, c.b)
+	}
+
+	_, err := compareSaltVersions("3006.x", "3006.1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+const selftestOutSuccess = `local:
+  Name: systemctl restart stay-on - Function: cmd.run - Result: Changed Started: - 15:14:07.884464 Duration: 79.173 ms
+  Name: version-reporter - Function: cmd.run - Result: Changed Started: - 15:14:19.717545 Duration: 113.323 ms
+
+Summary for local
+--------------
+Succeeded: 106 (changed=2)
+Failed:      0
+--------------
+Total states run:     106
+Total run time:    10.457 s`
+
+const selftestOutFail = `local:
+----------
+          ID: audiobait
+    Function: pkg.installed
+        Name: audiobait
+      Result: False
+     Comment: An error was encountered while installing package(s): E: Unable to locate package audiobait
+     Started: 15:14:10.120312
+    Duration: 2410.5 ms
+     Changes:
+
+Summary for local
+--------------
+Succeeded: 105 (changed=1)
+Failed:      1
+--------------
+Total states run:     106
+Total run time:    12.531 s`
+
+// selftestRunner is a SaltRunner that returns a fixed salt call output.
+type selftestRunner struct {
+	out string
+	err error
+}
+
+func (r *selftestRunner) Run(args []string) ([]byte, []byte, error) {
+	return []byte(r.out), nil, r.err
+}
+
+// selftest runs salt calls through the update code with a fake salt runner and checks the events
+// and state written. Salt, the network and the dbus service aren't used, and the files written
+// are in a temporary directory, so this can run while building a device image.
+func selftest() error {
+	dir, err := os.MkdirTemp("", "salt-helper-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "saltUpdate.json")
+	saltrequester.SetStateFile(stateFile)
+	saltCallLockFile = filepath.Join(dir, "salt-helper.lock")
+	historyFile = filepath.Join(dir, "salt-update-history.json")
+	eventQueueFile = filepath.Join(dir, "salt-helper-event-queue.json")
+	rebootRequiredFile = filepath.Join(dir, "reboot-required")
+	totalStatesCountFile = filepath.Join(dir, "salt-states-count")
+	events := []eventclient.Event{}
+	addEvent = func(event eventclient.Event) error {
+		events = append(events, event)
+		return nil
+	}
+
+	runner := &selftestRunner{}
+	salt := &saltUpdater{state: &saltrequester.SaltState{}, runner: runner, skipDelay: make(chan struct{}, 1), reloaded: make(chan struct{}, 1)}
+	updateArgs := append([]string{"state.apply"}, updateOutputArgs()...)
+
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"successful update", func() error {
+			runner.out, runner.err = selftestOutSuccess, nil
+			events = events[:0]
+			updateTime := time.Now().Truncate(time.Second)
+			if _, err := salt.runSaltCallSync(updateArgs, true, updateTime); err != nil {
+				return err
+			}
+			if err := checkSelftestEvent(events, true, 0); err != nil {
+				return err
+			}
+			state, err := saltrequester.StateFromFile()
+			if err != nil {
+				return err
+			}
+			if !state.LastCallSuccess || !state.LastUpdate.Equal(updateTime) || state.ConsecutiveFailures != 0 {
+				return fmt.Errorf("unexpected state after update: success %v, last update %s, failures %d",
+					state.LastCallSuccess, state.LastUpdate, state.ConsecutiveFailures)
+			}
+			if state.LastRunTimeSeconds != 10.457 || len(state.LastChanges) != 2 {
+				return fmt.Errorf("unexpected run time %v or changes %d", state.LastRunTimeSeconds, len(state.LastChanges))
+			}
+			return nil
+		}},
+		{"failed update", func() error {
+			runner.out, runner.err = selftestOutFail, nil
+			events = events[:0]
+			if _, err := salt.runSaltCallSync(updateArgs, true, time.Now()); err != nil {
+				return err
+			}
+			if err := checkSelftestEvent(events, false, 1); err != nil {
+				return err
+			}
+			failedStates, ok := events[0].Details["failedStates"].([]failedState)
+			if !ok || len(failedStates) != 1 || failedStates[0].ID != "audiobait" {
+				return fmt.Errorf("unexpected failed states in event: %v", events[0].Details["failedStates"])
+			}
+			state, err := saltrequester.StateFromFile()
+			if err != nil {
+				return err
+			}
+			if state.LastCallSuccess || state.ConsecutiveFailures != 1 {
+				return fmt.Errorf("unexpected state after failed update: success %v, failures %d", state.LastCallSuccess, state.ConsecutiveFailures)
+			}
+			return nil
+		}},
+		{"ping", func() error {
+			runner.out, runner.err = "local:\n    True", nil
+			state, err := salt.runSaltCallSync([]string{"test.ping"}, false, time.Now())
+			if err != nil {
+				return err
+			}
+			if !state.LastCallSuccess {
+				return errors.New("ping was not successful")
+			}
+			return nil
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			failed++
+		} else {
+			fmt.Printf("PASS %s\n", c.name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d self tests failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkSelftestEvent checks that one salt-update event was sent with the result and failed count.
+func checkSelftestEvent(events []eventclient.Event, success bool, failed float64) error {
+	if len(events) != 1 {
+		return fmt.Errorf("expected 1 event, got %d", len(events))
+	}
+	event := events[0]
+	if event.Type != eventType("salt-update") {
+		return fmt.Errorf("expected a salt-update event, got %s", event.Type)
+	}
+	if event.Details["success"] != success || event.Details["failed"] != failed {
+		return fmt.Errorf("unexpected event details: success %v, failed %v", event.Details["success"], event.Details["failed"])
+	}
+	return nil
+}
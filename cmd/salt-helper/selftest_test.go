@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelftest(t *testing.T) {
+	newTestSaltUpdater(t, &fakeSaltRunner{})
+	defer func() { addEvent = eventclient.AddEvent }()
+	assert.NoError(t, selftest())
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	saltrequester "github.com/TheCacophonyProject/salt-updater"
@@ -23,27 +24,27 @@ type service struct {
 	saltUpdater *saltUpdater
 }
 
-func startService(salt *saltUpdater) error {
+func startService(salt *saltUpdater) (*dbus.Conn, error) {
 	log.Println("Starting dbus service.")
 	conn, err := dbus.SystemBus()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	replyOld, err := conn.RequestName(oldDbusName, dbus.NameFlagDoNotQueue)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if replyOld != dbus.RequestNameReplyPrimaryOwner {
-		return errors.New("old dbus name already taken")
+		return nil, errors.New("old dbus name already taken")
 	}
 
 	replyNew, err := conn.RequestName(newDbusName, dbus.NameFlagDoNotQueue)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if replyNew != dbus.RequestNameReplyPrimaryOwner {
-		return errors.New("new dbus name already taken")
+		return nil, errors.New("new dbus name already taken")
 	}
 
 	oldService := &service{
@@ -65,7 +66,17 @@ func startService(salt *saltUpdater) error {
 	conn.Export(newService, newDbusPath, newDbusName)
 	conn.Export(genIntrospectable(newService, newDbusName), newDbusPath, "org.freedesktop.DBus.Introspectable")
 
-	return nil
+	return conn, nil
+}
+
+// stopService releases the dbus names so a new instance of the service can take them.
+func stopService(conn *dbus.Conn) {
+	log.Println("Stopping dbus service.")
+	for _, name := range []string{oldDbusName, newDbusName} {
+		if _, err := conn.ReleaseName(name); err != nil {
+			log.Errorf("Failed to release dbus name '%s': %v", name, err)
+		}
+	}
 }
 
 func genIntrospectable(v interface{}, dbusName string) introspect.Introspectable {
@@ -87,41 +98,79 @@ func (s *service) CheckIfUsingOldDbus() {
 // IsRunning will return true if a salt update is currently running
 func (s service) IsRunning() (bool, *dbus.Error) {
 	s.CheckIfUsingOldDbus()
-	return s.saltUpdater.state.RunningUpdate, nil
+	return s.saltUpdater.isRunning(), nil
 }
 
+// RunUpdate will run a salt update if there is one available
 func (s service) RunUpdate() *dbus.Error {
 	s.CheckIfUsingOldDbus()
+	s.saltUpdater.runUpdateIfAvailable(saltrequester.TriggerManual)
+	return nil
+}
 
-	updateAvailable, updateTime, err := saltrequester.UpdateExists()
-	if err != nil {
-		log.Printf("Error checking if update exists %v will run salt state", err)
-	}
-	//if we have an error lets just run salt update
-	if err == nil && !updateAvailable {
-		s.saltUpdater.state.UpdateProgressPercentage = 100
-		s.saltUpdater.state.UpdateProgressStr = "No update available"
-		log.Println("No update available")
-		return nil
-	}
+// RunUpdateJob will run a salt update if there is one available, returning the ID of the update job
+func (s service) RunUpdateJob() (string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	jobID, _ := s.saltUpdater.runUpdateIfAvailable(saltrequester.TriggerManual)
+	return jobID, nil
+}
 
-	go s.saltUpdater.runUpdate(updateTime)
-	return nil
+// RunUpdateIfAvailable will check for an update and start it if there is one, returning true if
+// an update was started. Use State to see the result of the update.
+func (s service) RunUpdateIfAvailable() (bool, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	_, started := s.saltUpdater.runUpdateIfAvailable(saltrequester.TriggerManual)
+	return started, nil
 }
 
+// ForceUpdate will run a salt update even if it is up to date
 func (s service) ForceUpdate() *dbus.Error {
+	_, err := s.ForceUpdateJob()
+	return err
+}
+
+// ForceUpdateJob will run a salt update even if it is up to date, returning the ID of the update job
+func (s service) ForceUpdateJob() (string, *dbus.Error) {
 	s.CheckIfUsingOldDbus()
-	go s.saltUpdater.runUpdate(time.Now())
-	return nil
+	jobID := s.saltUpdater.jobs.add(saltrequester.TriggerForce)
+	go s.saltUpdater.forceUpdate(jobID)
+	return jobID, nil
 }
 
-// RunPing will send a test ping to the salt server
+// JobStatus will return a JSON report of the progress or result of an update job
+func (s service) JobStatus(jobID string) ([]byte, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	job, ok := s.saltUpdater.jobStatus(jobID)
+	if !ok {
+		return nil, makeDbusError("JobStatus", s.dbusName, fmt.Errorf("unknown job '%s'", jobID))
+	}
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return nil, makeDbusError("JobStatus", s.dbusName, err)
+	}
+	return jobJSON, nil
+}
+
+// RunPing will send a test ping to the salt server, returning an error without pinging if
+// another salt call is running
 func (s service) RunPing() *dbus.Error {
 	s.CheckIfUsingOldDbus()
-	s.saltUpdater.runSaltCall([]string{"test.ping"}, false, time.Now())
+	if err := s.saltUpdater.runSaltCall([]string{"test.ping"}, false, time.Now()); err != nil {
+		return makeDbusError("RunPing", s.dbusName, err)
+	}
 	return nil
 }
 
+// RunModule will run a salt function from the module whitelist and return its output
+func (s service) RunModule(name string) (string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	out, err := s.saltUpdater.runModule(name)
+	if err != nil {
+		return "", makeDbusError("RunModule", s.dbusName, err)
+	}
+	return out, nil
+}
+
 func (s service) RunPingSync() ([]byte, *dbus.Error) {
 	s.CheckIfUsingOldDbus()
 	state, err := s.saltUpdater.runSaltCallSync([]string{"test.ping"}, false, time.Now())
@@ -138,13 +187,32 @@ func (s service) RunPingSync() ([]byte, *dbus.Error) {
 // State will get the current state of the salt update
 func (s service) State() ([]byte, *dbus.Error) {
 	s.CheckIfUsingOldDbus()
-	saltJSON, err := json.Marshal(s.saltUpdater.state)
+	saltJSON, err := s.saltUpdater.stateJSON()
 	if err != nil {
 		return nil, makeDbusError("State", s.dbusName, err)
 	}
 	return saltJSON, nil
 }
 
+// GetLastOutput will return the output of the last salt call. The output is capped by the
+// last-call-out-max-bytes config, use LastOutputTail for just the end of it.
+func (s service) GetLastOutput() (string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	return s.saltUpdater.state.LastCallOut, nil
+}
+
+// LastOutputTail will return the last lines of the output of the last salt call
+func (s service) LastOutputTail(lines int) (string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	return tailLines(s.saltUpdater.state.LastCallOut, lines), nil
+}
+
+// Progress will get the percentage and current stage of the salt update
+func (s service) Progress() (int, string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	return s.saltUpdater.state.UpdateProgressPercentage, s.saltUpdater.state.UpdateProgressStr, nil
+}
+
 func (s service) SetAutoUpdate(autoUpdate bool) *dbus.Error {
 	s.CheckIfUsingOldDbus()
 	err := setAutoUpdate(autoUpdate)
@@ -152,6 +220,7 @@ func (s service) SetAutoUpdate(autoUpdate bool) *dbus.Error {
 	if err != nil {
 		return makeDbusError("SetAutoUpdate", s.dbusName, err)
 	}
+	s.saltUpdater.wakeForReload()
 	return nil
 }
 
@@ -164,6 +233,233 @@ func (s service) IsAutoUpdateOn() (bool, *dbus.Error) {
 	return autoUpdate, nil
 }
 
+// GetRandomDelay will return the maximum random delay in minutes before a scheduled update
+func (s service) GetRandomDelay() (int, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	minutes, err := getRandomDelay()
+	if err != nil {
+		return 0, makeDbusError("GetRandomDelay", s.dbusName, err)
+	}
+	return minutes, nil
+}
+
+// SetRandomDelay will set the maximum random delay in minutes before a scheduled update
+func (s service) SetRandomDelay(minutes int) *dbus.Error {
+	s.CheckIfUsingOldDbus()
+	if err := setRandomDelay(minutes); err != nil {
+		return makeDbusError("SetRandomDelay", s.dbusName, err)
+	}
+	return nil
+}
+
+// GetUpdateWindow will return the start and end hours and the timezone of the window scheduled updates run in
+func (s service) GetUpdateWindow() (int, int, string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	start, end, timezone, err := getUpdateWindow()
+	if err != nil {
+		return 0, 0, "", makeDbusError("GetUpdateWindow", s.dbusName, err)
+	}
+	return start, end, timezone, nil
+}
+
+// SetUpdateWindow will set the start and end hours, 0-23, and the timezone of the window scheduled
+// updates run in, an empty timezone uses the local timezone
+func (s service) SetUpdateWindow(start, end int, timezone string) *dbus.Error {
+	s.CheckIfUsingOldDbus()
+	if err := setUpdateWindow(start, end, timezone); err != nil {
+		return makeDbusError("SetUpdateWindow", s.dbusName, err)
+	}
+	return nil
+}
+
+// HistorySince will return a JSON list of the updates in the update history that started after
+// the time, since is in RFC3339 format
+func (s service) HistorySince(since string) ([]byte, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	sinceTime, err := time.Parse(time.RFC3339Nano, since)
+	if err != nil {
+		return nil, makeDbusError("HistorySince", s.dbusName, err)
+	}
+	records, err := historySince(sinceTime)
+	if err != nil {
+		return nil, makeDbusError("HistorySince", s.dbusName, err)
+	}
+	recordsJSON, err := json.Marshal(records)
+	if err != nil {
+		return nil, makeDbusError("HistorySince", s.dbusName, err)
+	}
+	return recordsJSON, nil
+}
+
+// ReloadConfig will read the salt config again and apply it without restarting the service
+func (s service) ReloadConfig() *dbus.Error {
+	s.CheckIfUsingOldDbus()
+	if err := reloadSaltConfig(); err != nil {
+		return makeDbusError("ReloadConfig", s.dbusName, err)
+	}
+	s.saltUpdater.wakeForReload()
+	return nil
+}
+
+// SkipRandomDelay will end the random delay before a scheduled update so it runs now, returning
+// false if no scheduled update is waiting on a random delay
+func (s service) SkipRandomDelay() (bool, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	return s.saltUpdater.skipRandomDelay(), nil
+}
+
+// PinRef will pin updates to a saltops ref (branch or tag), an empty ref removes the pin
+func (s service) PinRef(ref string) *dbus.Error {
+	s.CheckIfUsingOldDbus()
+	if err := setPinnedRef(ref); err != nil {
+		return makeDbusError("PinRef", s.dbusName, err)
+	}
+	return nil
+}
+
+// GetPinnedRef will return the saltops ref that updates are pinned to
+func (s service) GetPinnedRef() (string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	ref, err := getPinnedRef()
+	if err != nil {
+		return "", makeDbusError("GetPinnedRef", s.dbusName, err)
+	}
+	return ref, nil
+}
+
+// MasterReachable will check if the salt master ports can be connected to, returning the latency in milliseconds
+func (s service) MasterReachable() (bool, int64, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	reachable, latency, err := checkMasterReachable()
+	if err != nil {
+		return false, 0, makeDbusError("MasterReachable", s.dbusName, err)
+	}
+	return reachable, latency.Milliseconds(), nil
+}
+
+// ResetState will clear a stuck running salt call and the progress from the salt state
+func (s service) ResetState(keepLastUpdate bool) *dbus.Error {
+	s.CheckIfUsingOldDbus()
+	if err := s.saltUpdater.resetState(keepLastUpdate); err != nil {
+		return makeDbusError("ResetState", s.dbusName, err)
+	}
+	return nil
+}
+
+// GetVersion will return the version of salt-helper that is running
+func (s service) GetVersion() (string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	return version, nil
+}
+
+// ApplyLocal will apply the salt states from a local saltops directory for testing
+func (s service) ApplyLocal(path string) *dbus.Error {
+	s.CheckIfUsingOldDbus()
+	if err := s.saltUpdater.applyLocal(path); err != nil {
+		return makeDbusError("ApplyLocal", s.dbusName, err)
+	}
+	return nil
+}
+
+// HealthCheck will return a JSON report of the salt and python versions and if the salt master is reachable
+func (s service) HealthCheck() ([]byte, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	report, err := healthCheck()
+	if err != nil {
+		return nil, makeDbusError("HealthCheck", s.dbusName, err)
+	}
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return nil, makeDbusError("HealthCheck", s.dbusName, err)
+	}
+	return reportJSON, nil
+}
+
+// PauseAutoUpdate will skip scheduled updates for the given milliseconds, 0 resumes them
+func (s service) PauseAutoUpdate(durationMs int64) *dbus.Error {
+	s.CheckIfUsingOldDbus()
+	if err := s.saltUpdater.pauseAutoUpdate(time.Duration(durationMs) * time.Millisecond); err != nil {
+		return makeDbusError("PauseAutoUpdate", s.dbusName, err)
+	}
+	s.saltUpdater.wakeForReload()
+	return nil
+}
+
+// GetNodegroupInfo will return a JSON report of the nodegroup from the nodegroup file, salt grains
+// and last salt call, and the saltops branch used
+func (s service) GetNodegroupInfo() ([]byte, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	info, err := getNodegroupInfo(s.saltUpdater.state)
+	if err != nil {
+		return nil, makeDbusError("GetNodegroupInfo", s.dbusName, err)
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return nil, makeDbusError("GetNodegroupInfo", s.dbusName, err)
+	}
+	return infoJSON, nil
+}
+
+// LastChanges will return a JSON list of the states that were changed by the last update
+func (s service) LastChanges() ([]byte, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	changes := s.saltUpdater.state.LastChanges
+	if changes == nil {
+		changes = []saltrequester.ChangeItem{}
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return nil, makeDbusError("LastChanges", s.dbusName, err)
+	}
+	return changesJSON, nil
+}
+
+// SaltInfo will return a JSON report of the salt minion version, salt master address and minion ID,
+// refresh reads the info again instead of using the cached info
+func (s service) SaltInfo(refresh bool) ([]byte, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	info, err := s.saltUpdater.saltInfo(refresh)
+	if err != nil {
+		return nil, makeDbusError("SaltInfo", s.dbusName, err)
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return nil, makeDbusError("SaltInfo", s.dbusName, err)
+	}
+	return infoJSON, nil
+}
+
+// MinionKeyAccepted will ping the salt master to check if it has accepted the minion key,
+// returning the key status: accepted, pending, rejected, no-response or unknown
+func (s service) MinionKeyAccepted() (bool, string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	accepted, status, err := s.saltUpdater.minionKeyAcceptedCheck()
+	if err != nil {
+		return false, "", makeDbusError("MinionKeyAccepted", s.dbusName, err)
+	}
+	return accepted, status, nil
+}
+
+// SetLastUpdate will set the time of the last successful update, timeStr is in RFC3339 format
+func (s service) SetLastUpdate(timeStr string, force bool) *dbus.Error {
+	s.CheckIfUsingOldDbus()
+	if err := s.saltUpdater.setLastUpdate(timeStr, force); err != nil {
+		return makeDbusError("SetLastUpdate", s.dbusName, err)
+	}
+	return nil
+}
+
+// NextUpdate will return the time of the next scheduled update check in RFC3339 format, or an
+// empty string if no update check is scheduled
+func (s service) NextUpdate() (string, *dbus.Error) {
+	s.CheckIfUsingOldDbus()
+	next := s.saltUpdater.state.NextScheduledUpdate
+	if next.IsZero() {
+		return "", nil
+	}
+	return next.Format(time.RFC3339), nil
+}
+
 func makeDbusError(name, dbusName string, err error) *dbus.Error {
 	return &dbus.Error{
 		Name: dbusName + "." + name,
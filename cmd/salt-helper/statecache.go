@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	saltrequester "github.com/TheCacophonyProject/salt-updater"
+)
+
+// stateCache holds the salt state marshalled to JSON so State calls don't marshal the
+// state, including the large LastCallOut, every time when it hasn't changed.
+type stateCache struct {
+	mu    sync.Mutex
+	json  []byte
+	dirty bool
+}
+
+// stateChanged marks the cached state JSON as out of date. It must be called after the state is changed.
+func (s *saltUpdater) stateChanged() {
+	s.stateCache.mu.Lock()
+	s.stateCache.dirty = true
+	s.stateCache.mu.Unlock()
+}
+
+// saveState marks the state as changed and writes it to the state file. Only the end of
+// LastCallOut, up to stateFileOutMaxBytes, is written to bound the size of the state file.
+func (s *saltUpdater) saveState() error {
+	s.stateChanged()
+	fileState := *s.state
+	fileState.LastCallOut = truncateHead(fileState.LastCallOut, stateFileOutMaxBytes)
+	return saltrequester.WriteStateFile(&fileState)
+}
+
+// stateJSON returns the salt state as JSON, only marshalling it again if it has changed.
+func (s *saltUpdater) stateJSON() ([]byte, error) {
+	s.stateCache.mu.Lock()
+	defer s.stateCache.mu.Unlock()
+	if s.stateCache.json != nil && !s.stateCache.dirty {
+		return s.stateCache.json, nil
+	}
+	stateJSON, err := json.Marshal(s.state)
+	if err != nil {
+		return nil, err
+	}
+	s.stateCache.json = stateJSON
+	s.stateCache.dirty = false
+	return stateJSON, nil
+}
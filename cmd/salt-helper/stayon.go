@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/godbus/dbus"
+)
+
+// The stay-on dbus service keeps the device powered on while there are requests held.
+const (
+	stayOnDbusDest   = "org.cacophony.StayOn"
+	stayOnDbusPath   = "/org/cacophony/StayOn"
+	stayOnMethodBase = "org.cacophony.StayOn"
+)
+
+// stayOnReason is sent with the stay-on request so it can be seen what is keeping the device on.
+const stayOnReason = "salt-update"
+
+// dbusCaller is the part of a dbus object used to call the stay-on service.
+type dbusCaller interface {
+	Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call
+}
+
+// getStayOnObj returns the stay-on dbus object, a var so tests can use a fake.
+var getStayOnObj = systemStayOnObj
+
+func systemStayOnObj() (dbusCaller, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Object(stayOnDbusDest, stayOnDbusPath), nil
+}
+
+// requestStayOn asks the stay-on service to keep the device on during an update. The returned
+// function releases the request. The stay-on service itself isn't started or stopped as salt
+// manages it. This is best effort, if the request fails the update still runs.
+func requestStayOn() func() {
+	obj, err := getStayOnObj()
+	if err != nil {
+		log.Errorf("Failed to request stay-on for the update: %v", err)
+		return func() {}
+	}
+	var requestID string
+	if err := obj.Call(stayOnMethodBase+".Request", 0, stayOnReason).Store(&requestID); err != nil {
+		log.Errorf("Failed to request stay-on for the update: %v", err)
+		return func() {}
+	}
+	log.Printf("Requested stay-on for the update, request %s", requestID)
+	return func() {
+		if err := obj.Call(stayOnMethodBase+".Release", 0, requestID).Store(); err != nil {
+			log.Errorf("Failed to release stay-on after the update: %v", err)
+			return
+		}
+		log.Println("Released stay-on after the update")
+	}
+}
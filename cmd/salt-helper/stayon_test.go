@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStayOn records the calls made to the stay-on service.
+type fakeStayOn struct {
+	calls []string
+	args  [][]interface{}
+	err   error
+}
+
+func (f *fakeStayOn) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	f.calls = append(f.calls, method)
+	f.args = append(f.args, args)
+	var body []interface{}
+	if method == stayOnMethodBase+".Request" {
+		body = []interface{}{"req-1"}
+	}
+	return &dbus.Call{Method: method, Args: args, Body: body, Err: f.err}
+}
+
+func useFakeStayOn(t *testing.T, fake *fakeStayOn) {
+	log = logging.NewLogger("info")
+	getStayOnObj = func() (dbusCaller, error) { return fake, nil }
+	t.Cleanup(func() { getStayOnObj = systemStayOnObj })
+}
+
+func TestRequestStayOn(t *testing.T) {
+	fake := &fakeStayOn{}
+	useFakeStayOn(t, fake)
+
+	release := requestStayOn()
+	assert.Equal(t, []string{stayOnMethodBase + ".Request"}, fake.calls)
+	assert.Equal(t, []interface{}{stayOnReason}, fake.args[0])
+	release()
+	assert.Equal(t, stayOnMethodBase+".Release", fake.calls[1])
+	assert.Equal(t, []interface{}{"req-1"}, fake.args[1])
+}
+
+func TestRequestStayOnUnavailable(t *testing.T) {
+	fake := &fakeStayOn{err: errors.New("org.cacophony.StayOn was not provided by any .service files")}
+	useFakeStayOn(t, fake)
+
+	// The update still runs, there is nothing to release.
+	release := requestStayOn()
+	release()
+	assert.Equal(t, []string{stayOnMethodBase + ".Request"}, fake.calls)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// validateUpdateWindow checks the update window hours are 0-23 and the timezone can be loaded.
+func validateUpdateWindow(start, end int, timezone string) (*time.Location, error) {
+	if start < 0 || start > 23 {
+		return nil, fmt.Errorf("update window start hour %d is not between 0 and 23", start)
+	}
+	if end < 0 || end > 23 {
+		return nil, fmt.Errorf("update window end hour %d is not between 0 and 23", end)
+	}
+	if timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid update window timezone '%s': %v", timezone, err)
+	}
+	return loc, nil
+}
+
+func setUpdateWindow(start, end int, timezone string) error {
+	if _, err := validateUpdateWindow(start, end, timezone); err != nil {
+		return err
+	}
+	return updateSaltConfig(map[string]interface{}{
+		"update-window-start":    start,
+		"update-window-end":      end,
+		"update-window-timezone": timezone,
+	})
+}
+
+func getUpdateWindow() (int, int, string, error) {
+	saltSetup, err := readSaltConfig()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return saltSetup.UpdateWindowStart, saltSetup.UpdateWindowEnd, saltSetup.UpdateWindowTimezone, nil
+}
+
+// untilUpdateWindow returns how long until the update window starts, 0 if now is in the window.
+// The window is from the start hour up to the end hour and can go past midnight. A window with
+// the same start and end hour is always open.
+func untilUpdateWindow(now time.Time, start, end int, loc *time.Location) time.Duration {
+	if start == end {
+		return 0
+	}
+	now = now.In(loc)
+	hour := now.Hour()
+	if start < end && hour >= start && hour < end {
+		return 0
+	}
+	if start > end && (hour >= start || hour < end) {
+		return 0
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), start, 0, 0, 0, loc)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Sub(now)
+}
+
+// untilUpdateWindowCloses returns how long until the update window closes, 0 if now is outside the
+// window. ok is false if the window is always open.
+func untilUpdateWindowCloses(now time.Time, start, end int, loc *time.Location) (time.Duration, bool) {
+	if start == end {
+		return 0, false
+	}
+	if untilUpdateWindow(now, start, end, loc) > 0 {
+		return 0, true
+	}
+	now = now.In(loc)
+	closes := time.Date(now.Year(), now.Month(), now.Day(), end, 0, 0, 0, loc)
+	if !closes.After(now) {
+		closes = closes.AddDate(0, 0, 1)
+	}
+	return closes.Sub(now), true
+}
+
+// waitForUpdateWindow sleeps until the configured update window starts, so scheduled updates
+// only run in the window. Returns true if it had to wait.
+func waitForUpdateWindow(saltSetup *saltConfig) bool {
+	loc, err := validateUpdateWindow(saltSetup.UpdateWindowStart, saltSetup.UpdateWindowEnd, saltSetup.UpdateWindowTimezone)
+	if err != nil {
+		log.Errorf("Ignoring update window: %v", err)
+		return false
+	}
+	wait := untilUpdateWindow(time.Now(), saltSetup.UpdateWindowStart, saltSetup.UpdateWindowEnd, loc)
+	if wait <= 0 {
+		return false
+	}
+	log.Printf("Outside the update window, waiting %s for it to start", wait.Round(time.Second))
+	sleepWithHeartbeat(wait)
+	return true
+}
+
+// maxRandomDelay returns the longest random delay before a scheduled update starting at now. It is
+// the configured random delay, capped at the time left in the update window so the update still
+// starts in the window.
+func maxRandomDelay(saltSetup *saltConfig, now time.Time) time.Duration {
+	maxDelay := time.Duration(saltSetup.RandomDelayMinutes) * time.Minute
+	loc, err := validateUpdateWindow(saltSetup.UpdateWindowStart, saltSetup.UpdateWindowEnd, saltSetup.UpdateWindowTimezone)
+	if err != nil {
+		return maxDelay
+	}
+	if remaining, ok := untilUpdateWindowCloses(now, saltSetup.UpdateWindowStart, saltSetup.UpdateWindowEnd, loc); ok {
+		maxDelay = min(maxDelay, remaining)
+	}
+	return maxDelay
+}
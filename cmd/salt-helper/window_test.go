@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateUpdateWindow(t *testing.T) {
+	_, err := validateUpdateWindow(2, 5, "")
+	assert.NoError(t, err)
+	loc, err := validateUpdateWindow(22, 4, "UTC")
+	assert.NoError(t, err)
+	assert.Equal(t, time.UTC, loc)
+
+	_, err = validateUpdateWindow(24, 5, "")
+	assert.Error(t, err)
+	_, err = validateUpdateWindow(2, -1, "")
+	assert.Error(t, err)
+	_, err = validateUpdateWindow(2, 5, "Not/AZone")
+	assert.Error(t, err)
+}
+
+func TestUntilUpdateWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	// Always open when the start and end are the same.
+	assert.Equal(t, time.Duration(0), untilUpdateWindow(at(12, 0), 0, 0, time.UTC))
+
+	assert.Equal(t, time.Duration(0), untilUpdateWindow(at(3, 0), 2, 5, time.UTC))
+	assert.Equal(t, 30*time.Minute, untilUpdateWindow(at(1, 30), 2, 5, time.UTC))
+	assert.Equal(t, 21*time.Hour, untilUpdateWindow(at(5, 0), 2, 5, time.UTC))
+
+	// A window past midnight.
+	assert.Equal(t, time.Duration(0), untilUpdateWindow(at(23, 0), 22, 4, time.UTC))
+	assert.Equal(t, time.Duration(0), untilUpdateWindow(at(1, 0), 22, 4, time.UTC))
+	assert.Equal(t, 10*time.Hour, untilUpdateWindow(at(12, 0), 22, 4, time.UTC))
+
+	// The hours are in the window's timezone.
+	nz := time.FixedZone("NZST", 12*60*60)
+	assert.Equal(t, time.Duration(0), untilUpdateWindow(at(15, 0), 2, 5, nz))
+}
+
+func TestUntilUpdateWindowCloses(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	_, ok := untilUpdateWindowCloses(at(12, 0), 0, 0, time.UTC)
+	assert.False(t, ok)
+
+	remaining, ok := untilUpdateWindowCloses(at(4, 30), 2, 5, time.UTC)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Minute, remaining)
+	remaining, _ = untilUpdateWindowCloses(at(6, 0), 2, 5, time.UTC)
+	assert.Equal(t, time.Duration(0), remaining)
+
+	// A window past midnight.
+	remaining, _ = untilUpdateWindowCloses(at(23, 0), 22, 4, time.UTC)
+	assert.Equal(t, 5*time.Hour, remaining)
+	remaining, _ = untilUpdateWindowCloses(at(3, 0), 22, 4, time.UTC)
+	assert.Equal(t, time.Hour, remaining)
+}
+
+func TestMaxRandomDelay(t *testing.T) {
+	now := time.Date(2024, 5, 1, 4, 50, 0, 0, time.UTC)
+	saltSetup := defaultSaltConfig()
+	saltSetup.RandomDelayMinutes = 60
+	saltSetup.UpdateWindowTimezone = "UTC"
+	assert.Equal(t, time.Hour, maxRandomDelay(&saltSetup, now))
+
+	// The delay is capped so the update still starts in a short window.
+	saltSetup.UpdateWindowStart = 4
+	saltSetup.UpdateWindowEnd = 5
+	assert.Equal(t, 10*time.Minute, maxRandomDelay(&saltSetup, now))
+
+	// A delay shorter than the time left in the window isn't changed.
+	saltSetup.RandomDelayMinutes = 5
+	assert.Equal(t, 5*time.Minute, maxRandomDelay(&saltSetup, now))
+}
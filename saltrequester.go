@@ -5,9 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 
 	"time"
 
@@ -16,14 +22,25 @@ import (
 )
 
 const (
-	dbusPath       = "/org/cacophony/salt_helper"
-	dbusDest       = "org.cacophony.salt_helper"
-	methodBase     = "org.cacophony.salt_helper"
-	saltVersionUrl = "https://raw.githubusercontent.com/TheCacophonyProject/salt-version-info/refs/heads/main/salt-version-info.json"
+	dbusPath          = "/org/cacophony/salt_helper"
+	dbusDest          = "org.cacophony.salt_helper"
+	methodBase        = "org.cacophony.salt_helper"
+	saltVersionUrl    = "https://raw.githubusercontent.com/TheCacophonyProject/salt-version-info/refs/heads/main/salt-version-info.json"
+	saltopsCommitsUrl = "https://api.github.com/repos/TheCacophonyProject/saltops/commits/"
+	nodegroupFile     = "/etc/cacophony/salt-nodegroup"
 )
 
 var log = logging.NewLogger("info")
 
+// ErrOffline is returned when the update check fails because the device has no network connection.
+var ErrOffline = errors.New("device is offline")
+
+// ErrUnknownNodegroup is returned when the nodegroup has no saltops branch mapped to it.
+var ErrUnknownNodegroup = errors.New("no salt branch mapping for nodegroup")
+
+// ErrBranchNotFound is returned when a saltops branch isn't in the salt-version-info json.
+var ErrBranchNotFound = errors.New("saltops branch not found in the version info")
+
 var nodeGroupToBranch = map[string]string{
 	"tc2-dev":  "dev",
 	"tc2-test": "test",
@@ -35,28 +52,203 @@ var nodeGroupToBranch = map[string]string{
 
 // SaltState holds info of the current state of salt
 type SaltState struct {
-	RunningUpdate            bool
-	RunningArgs              []string
-	LastCallOut              string
-	LastCallSuccess          bool
-	LastCallNodegroup        string
-	LastCallArgs             []string
-	LastUpdate               time.Time
-	UpdateProgressPercentage int
-	UpdateProgressStr        string
+	RunningUpdate             bool
+	RunningArgs               []string
+	LastCallOut               string
+	LastCallSuccess           bool
+	LastCallNodegroup         string
+	LastCallBranch            string
+	LastCallArgs              []string
+	LastCallLocalPath         string    // Set when the last call applied local states for testing
+	LastUpdate                time.Time // Last successful update
+	LastAttempt               time.Time // Last update attempt, successful or not
+	LastTrigger               UpdateTrigger
+	JobID                     string    // Job of the running or last update, see JobStatus
+	RebootPending             bool      // The last update needs a reboot to finish
+	RebootedForUpdate         bool      // The device rebooted after, or during, the last update
+	LastModemPing             time.Time // Last salt ping after the modem connected
+	LastModemPingSuccess      bool
+	AutoUpdatePausedUntil     time.Time // Scheduled updates are skipped until this time
+	NextScheduledUpdate       time.Time // Next scheduled update check, before its random delay. Zero while checking or if auto update is off or paused
+	LastRunTimeSeconds        float64
+	ConsecutiveFailures       int
+	PendingEvents             int // Events that failed to send, waiting to be sent again
+	LastUpdateVersion         string
+	LastUpdateSHA             string
+	AvailableVersion          string
+	AvailableSHA              string
+	UpdateProgressPercentage  int
+	UpdateProgressStr         string
+	EstimatedSecondsRemaining int // UnknownTimeRemaining if there is no previous run to estimate from
+	AppliedStates             []string
+	LastChanges               []ChangeItem // States changed by the last update
+	// LastCallSummary is parsed from the full output of the last update, as LastCallOut can be
+	// truncated, e.g. JSON output that can no longer be parsed. Nil if the last call wasn't an
+	// update or had no summary.
+	LastCallSummary     *StateSummary
+	SlowestState        string // Slowest state of the last update
+	SlowestStateSeconds float64
+	SaltVersion         string
+}
+
+// StateSummary is the number of states run by a salt update, by result.
+type StateSummary struct {
+	Succeeded int
+	Changed   int
+	Failed    int
+	Total     int
+}
+
+// UpdateTrigger is what started a salt update.
+type UpdateTrigger string
+
+const (
+	TriggerScheduled       UpdateTrigger = "scheduled"
+	TriggerManual          UpdateTrigger = "manual"
+	TriggerForce           UpdateTrigger = "force"
+	TriggerNodegroupChange UpdateTrigger = "nodegroup-change"
+	TriggerModem           UpdateTrigger = "modem"
+)
+
+// UpdateRecord is the result of an update, kept in the update history.
+type UpdateRecord struct {
+	Time           time.Time // When the update started
+	Trigger        UpdateTrigger
+	JobID          string
+	Success        bool
+	Nodegroup      string
+	Branch         string
+	Version        string
+	SHA            string
+	RunTimeSeconds float64
+	FailedStates   int
+	RebootPending  bool
+}
+
+// JobState is the state of an update job.
+type JobState string
+
+const (
+	JobPending   JobState = "pending"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobSkipped   JobState = "skipped" // No update was run, e.g. there was no update available
+)
+
+// UpdateJob is the progress or result of an update request. Each call to RunUpdate or ForceUpdate
+// gets its own job so its result isn't lost if another update is requested.
+type UpdateJob struct {
+	ID                 string
+	Trigger            UpdateTrigger
+	State              JobState
+	Result             string // Why the job was skipped or failed, or the update progress
+	ProgressPercentage int
+	Created            time.Time
+	Finished           time.Time
+}
+
+// HealthReport holds key facts about the health of the salt minion
+type HealthReport struct {
+	SaltVersion     string
+	PythonVersion   string
+	MasterReachable bool
+	MasterLatency   time.Duration
+}
+
+// MinionInfo holds details of the salt minion for inventory
+type MinionInfo struct {
+	MinionVersion string
+	MasterAddress string
+	MinionID      string
+}
+
+// ChangeItem is a salt state that made changes in an update. Diff holds the changes salt
+// reported, a file diff for file states.
+type ChangeItem struct {
+	ID       string
+	Function string
+	Name     string
+	Diff     string
+}
+
+// NodegroupInfo holds the nodegroup from each of the places it is recorded, and the saltops
+// branch used. The nodegroups are consistent when they all match.
+type NodegroupInfo struct {
+	FileNodegroup  string
+	GrainNodegroup string
+	StateNodegroup string
+	Branch         string
+	Consistent     bool
+}
+
+// NormalizeNodegroup removes the whitespace, including "\r\n" line endings, around a nodegroup.
+// Nodegroups read from a file or command output should be normalized before being compared.
+func NormalizeNodegroup(nodegroup string) string {
+	return strings.TrimSpace(nodegroup)
+}
+
+// ReadNodegroup reads the normalized nodegroup from the nodegroup file.
+func ReadNodegroup() (string, error) {
+	nodegroup, err := os.ReadFile(nodegroupFile)
+	if err != nil {
+		return "", err
+	}
+	return NormalizeNodegroup(string(nodegroup)), nil
+}
+
+// NodegroupBranch returns the saltops branch that the nodegroup uses.
+func NodegroupBranch(nodegroup string) (string, bool) {
+	branch, ok := nodeGroupToBranch[NormalizeNodegroup(nodegroup)]
+	return branch, ok
+}
+
+// Update channels. A device on the stable channel follows the branch its nodegroup
+// maps to, a device on the beta channel follows the next less stable branch.
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+)
+
+// betaBranches maps a branch to the branch that is used on the beta channel.
+var betaBranches = map[string]string{
+	"prod": "test",
+	"test": "dev",
+	"dev":  "dev",
+}
+
+// ResolveBranch returns the saltops branch to use for the nodegroup and channel.
+// The nodegroup selects the base branch, then the channel can move it to a less stable branch.
+// An empty channel is the same as the stable channel.
+func ResolveBranch(nodegroup, channel string) (string, error) {
+	branch, ok := NodegroupBranch(nodegroup)
+	if !ok {
+		return "", fmt.Errorf("%w '%v'", ErrUnknownNodegroup, NormalizeNodegroup(nodegroup))
+	}
+	switch channel {
+	case "", ChannelStable:
+		return branch, nil
+	case ChannelBeta:
+		return betaBranches[branch], nil
+	default:
+		return "", fmt.Errorf("unknown update channel '%s'", channel)
+	}
 }
 
+// UnknownTimeRemaining is used for SaltState.EstimatedSecondsRemaining when it can't be estimated.
+const UnknownTimeRemaining = -1
+
 // IsRunning will return true if a salt update is running
 func IsRunning() (bool, error) {
 	obj, err := getDbusObj()
 	if err != nil {
 		return false, err
 	}
-	if err := obj.Call(methodBase+".IsRunning", 0).Store(); err != nil {
+	var running bool
+	if err := obj.Call(methodBase+".IsRunning", 0).Store(&running); err != nil {
 		return false, err
 	}
-
-	return false, nil
+	return running, nil
 }
 
 // RunUpdate will run a salt update if one is not already running
@@ -68,7 +260,32 @@ func RunUpdate() error {
 	return obj.Call(methodBase+".RunUpdate", 0).Store()
 }
 
-// RunUpdate will run a salt update if one is not already running
+// RunUpdateJob will run a salt update if one is not already running, returning the ID of the
+// update job. Use JobStatus to see the result of the job.
+func RunUpdateJob() (string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return "", err
+	}
+	var jobID string
+	err = obj.Call(methodBase+".RunUpdateJob", 0).Store(&jobID)
+	return jobID, err
+}
+
+// RunUpdateIfAvailable will check for an update and start it if there is one, returning true if
+// an update was started. Unlike calling UpdateExists then RunUpdate the check is done by the
+// salt-helper service so it is the same check that decides if the update runs.
+func RunUpdateIfAvailable() (bool, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return false, err
+	}
+	var started bool
+	err = obj.Call(methodBase+".RunUpdateIfAvailable", 0).Store(&started)
+	return started, err
+}
+
+// ForceUpdate will run a salt update even if it is up to date
 func ForceUpdate() error {
 	obj, err := getDbusObj()
 	if err != nil {
@@ -77,7 +294,38 @@ func ForceUpdate() error {
 	return obj.Call(methodBase+".ForceUpdate", 0).Store()
 }
 
-// RunPing will ping the salt server if a salt call is not already running
+// ForceUpdateJob will run a salt update even if it is up to date, returning the ID of the update job.
+// Use JobStatus to see the result of the job.
+func ForceUpdateJob() (string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return "", err
+	}
+	var jobID string
+	err = obj.Call(methodBase+".ForceUpdateJob", 0).Store(&jobID)
+	return jobID, err
+}
+
+// JobStatus will return the progress or result of an update job
+func JobStatus(jobID string) (*UpdateJob, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	jobBytes := []byte{}
+	if err := obj.Call(methodBase+".JobStatus", 0, jobID).Store(&jobBytes); err != nil {
+		return nil, err
+	}
+	job := &UpdateJob{}
+	if err := json.Unmarshal(jobBytes, job); err != nil {
+		log.Println("failed to unmarshal UpdateJob")
+		return nil, err
+	}
+	return job, nil
+}
+
+// RunPing will ping the salt server. An error is returned, and the ping isn't run, if a salt
+// update or another ping is running
 func RunPing() error {
 	obj, err := getDbusObj()
 	if err != nil {
@@ -86,6 +334,18 @@ func RunPing() error {
 	return obj.Call(methodBase+".RunPing", 0).Store()
 }
 
+// RunModule will run a read only salt function, e.g. "disk.usage", and return its output. Only
+// the functions in the module whitelist of the salt config can be run.
+func RunModule(name string) (string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return "", err
+	}
+	var out string
+	err = obj.Call(methodBase+".RunModule", 0, name).Store(&out)
+	return out, err
+}
+
 // RunPingSync will make a synchronous ping call to the server
 func RunPingSync() (*SaltState, error) {
 	obj, err := getDbusObj()
@@ -122,6 +382,20 @@ func State() (*SaltState, error) {
 	return state, nil
 }
 
+// Progress will return the percentage and current stage of the salt update
+func Progress() (int, string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return 0, "", err
+	}
+	var percentage int
+	var stage string
+	if err := obj.Call(methodBase+".Progress", 0).Store(&percentage, &stage); err != nil {
+		return 0, "", err
+	}
+	return percentage, stage, nil
+}
+
 func SetAutoUpdate(autoUpdate bool) error {
 	obj, err := getDbusObj()
 	if err != nil {
@@ -142,7 +416,319 @@ func IsAutoUpdateOn() (bool, error) {
 	return autoupdate, nil
 }
 
-func getDbusObj() (dbus.BusObject, error) {
+// GetRandomDelay will return the maximum random delay in minutes before a scheduled update
+func GetRandomDelay() (int, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return 0, err
+	}
+	var minutes int
+	if err := obj.Call(methodBase+".GetRandomDelay", 0).Store(&minutes); err != nil {
+		return 0, err
+	}
+	return minutes, nil
+}
+
+// SetRandomDelay will set the maximum random delay in minutes before a scheduled update
+func SetRandomDelay(minutes int) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".SetRandomDelay", 0, minutes).Store()
+}
+
+// GetUpdateWindow will return the start and end hours and the timezone of the window scheduled
+// updates run in. The window is always open if the start and end are the same.
+func GetUpdateWindow() (int, int, string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	var start, end int
+	var timezone string
+	if err := obj.Call(methodBase+".GetUpdateWindow", 0).Store(&start, &end, &timezone); err != nil {
+		return 0, 0, "", err
+	}
+	return start, end, timezone, nil
+}
+
+// SetUpdateWindow will set the start and end hours, 0-23, and the timezone of the window scheduled
+// updates run in. An empty timezone uses the device's local timezone.
+func SetUpdateWindow(start, end int, timezone string) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".SetUpdateWindow", 0, start, end, timezone).Store()
+}
+
+// HistorySince will return the update records from the update history that started after the
+// given time, oldest first. A zero time returns the whole history.
+func HistorySince(since time.Time) ([]UpdateRecord, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	historyBytes := []byte{}
+	if err := obj.Call(methodBase+".HistorySince", 0, since.Format(time.RFC3339Nano)).Store(&historyBytes); err != nil {
+		return nil, err
+	}
+	records := []UpdateRecord{}
+	if err := json.Unmarshal(historyBytes, &records); err != nil {
+		log.Println("failed to unmarshal UpdateRecords")
+		return nil, err
+	}
+	return records, nil
+}
+
+// ReloadConfig will make the salt-helper service read the salt config again, so config changes
+// apply without restarting the service
+func ReloadConfig() error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".ReloadConfig", 0).Store()
+}
+
+// SkipRandomDelay will end the random delay before a scheduled update so it runs now, returning
+// false if no scheduled update is waiting on a random delay
+func SkipRandomDelay() (bool, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return false, err
+	}
+	var skipped bool
+	err = obj.Call(methodBase+".SkipRandomDelay", 0).Store(&skipped)
+	return skipped, err
+}
+
+// PinRef will pin updates to the given saltops ref (branch or tag), an empty ref removes the pin
+func PinRef(ref string) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".PinRef", 0, ref).Store()
+}
+
+// GetPinnedRef will return the saltops ref updates are pinned to, empty if not pinned
+func GetPinnedRef() (string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return "", err
+	}
+	var ref string
+	if err := obj.Call(methodBase+".GetPinnedRef", 0).Store(&ref); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+// MasterReachable will check if the salt master can be connected to and how long it took
+func MasterReachable() (bool, time.Duration, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return false, 0, err
+	}
+	var reachable bool
+	var latencyMs int64
+	if err := obj.Call(methodBase+".MasterReachable", 0).Store(&reachable, &latencyMs); err != nil {
+		return false, 0, err
+	}
+	return reachable, time.Duration(latencyMs) * time.Millisecond, nil
+}
+
+// ResetState will clear a stuck running salt call and the progress from the salt state.
+// This will fail if salt-call is still running.
+func ResetState(keepLastUpdate bool) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".ResetState", 0, keepLastUpdate).Store()
+}
+
+// Version will return the version of the salt-helper service that is running
+func Version() (string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return "", err
+	}
+	var version string
+	if err := obj.Call(methodBase+".GetVersion", 0).Store(&version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// ApplyLocal will apply the salt states from a local saltops directory for testing.
+// This is not counted as an update.
+func ApplyLocal(path string) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".ApplyLocal", 0, path).Store()
+}
+
+// HealthCheck will get the salt and python versions of the minion and check if the salt master is reachable
+func HealthCheck() (*HealthReport, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	reportBytes := []byte{}
+	if err := obj.Call(methodBase+".HealthCheck", 0).Store(&reportBytes); err != nil {
+		return nil, err
+	}
+	report := &HealthReport{}
+	if err := json.Unmarshal(reportBytes, report); err != nil {
+		log.Println("failed to unmarshal HealthReport")
+		return nil, err
+	}
+	return report, nil
+}
+
+// LastChanges will return the states that were changed by the last update
+func LastChanges() ([]ChangeItem, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	changesBytes := []byte{}
+	if err := obj.Call(methodBase+".LastChanges", 0).Store(&changesBytes); err != nil {
+		return nil, err
+	}
+	changes := []ChangeItem{}
+	if err := json.Unmarshal(changesBytes, &changes); err != nil {
+		log.Println("failed to unmarshal LastChanges")
+		return nil, err
+	}
+	return changes, nil
+}
+
+// GetNodegroupInfo will return the nodegroup from the nodegroup file, salt grains and last
+// salt call, and the saltops branch used
+func GetNodegroupInfo() (*NodegroupInfo, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	infoBytes := []byte{}
+	if err := obj.Call(methodBase+".GetNodegroupInfo", 0).Store(&infoBytes); err != nil {
+		return nil, err
+	}
+	info := &NodegroupInfo{}
+	if err := json.Unmarshal(infoBytes, info); err != nil {
+		log.Println("failed to unmarshal NodegroupInfo")
+		return nil, err
+	}
+	return info, nil
+}
+
+// SaltInfo will return the salt minion version, salt master address and minion ID. The info is
+// cached by the salt-helper service, refresh reads it again.
+func SaltInfo(refresh bool) (*MinionInfo, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return nil, err
+	}
+	infoBytes := []byte{}
+	if err := obj.Call(methodBase+".SaltInfo", 0, refresh).Store(&infoBytes); err != nil {
+		return nil, err
+	}
+	info := &MinionInfo{}
+	if err := json.Unmarshal(infoBytes, info); err != nil {
+		log.Println("failed to unmarshal MinionInfo")
+		return nil, err
+	}
+	return info, nil
+}
+
+// MinionKeyAccepted will ping the salt master to check if it has accepted the minion key,
+// returning the key status: accepted, pending, rejected, no-response or unknown
+func MinionKeyAccepted() (bool, string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return false, "", err
+	}
+	var accepted bool
+	var status string
+	err = obj.Call(methodBase+".MinionKeyAccepted", 0).Store(&accepted, &status)
+	return accepted, status, err
+}
+
+// LastOutput will return the output of the last salt call
+func LastOutput() (string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return "", err
+	}
+	var out string
+	err = obj.Call(methodBase+".GetLastOutput", 0).Store(&out)
+	return out, err
+}
+
+// LastOutputTail will return the last lines of the output of the last salt call,
+// a smaller alternative to LastCallOut from State
+func LastOutputTail(lines int) (string, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return "", err
+	}
+	var out string
+	err = obj.Call(methodBase+".LastOutputTail", 0, lines).Store(&out)
+	return out, err
+}
+
+// PauseAutoUpdate will skip scheduled updates and RunUpdate for the given duration, a duration of 0
+// resumes them. ForceUpdate still runs an update while paused. The pause time is in AutoUpdatePausedUntil from State.
+func PauseAutoUpdate(duration time.Duration) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".PauseAutoUpdate", 0, duration.Milliseconds()).Store()
+}
+
+// SetLastUpdate will set the time of the last successful update, timeStr is in RFC3339 format.
+// Setting a time in the future needs force.
+func SetLastUpdate(timeStr string, force bool) error {
+	obj, err := getDbusObj()
+	if err != nil {
+		return err
+	}
+	return obj.Call(methodBase+".SetLastUpdate", 0, timeStr, force).Store()
+}
+
+// NextUpdate will return the time of the next scheduled update check, before its random delay.
+// Returns a zero time if no update check is scheduled.
+func NextUpdate() (time.Time, error) {
+	obj, err := getDbusObj()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var timeStr string
+	if err := obj.Call(methodBase+".NextUpdate", 0).Store(&timeStr); err != nil {
+		return time.Time{}, err
+	}
+	if timeStr == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, timeStr)
+}
+
+// busObject is the part of dbus.BusObject used to call the salt-helper service, so tests can use a fake.
+type busObject interface {
+	Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call
+}
+
+// getDbusObj gets the salt-helper dbus object, a var so tests can return a fake.
+var getDbusObj = systemBusObj
+
+func systemBusObj() (busObject, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return nil, err
@@ -151,23 +737,71 @@ func getDbusObj() (dbus.BusObject, error) {
 	return obj, nil
 }
 
-const saltUpdateFile = "/etc/cacophony/saltUpdate.json"
+// saltUpdateFile is where the salt state is saved, a var so tests can change it.
+var saltUpdateFile = "/etc/cacophony/saltUpdate.json"
 
-// possibly need file locks??
-func WriteStateFile(saltState *SaltState) error {
+// SetStateFile changes where the salt state is saved, used by tests outside of this package.
+func SetStateFile(path string) {
+	saltUpdateFile = path
+}
 
+// WriteStateFile saves the salt state, retrying a few times if the write fails.
+// The state passed in is not changed if it can't be saved.
+func WriteStateFile(saltState *SaltState) error {
 	saltStateJSON, err := json.Marshal(saltState)
 	if err != nil {
 		log.Printf("failed to marshal saltUpdater: %v\n", err)
 		return err
 	}
-	err = os.WriteFile(saltUpdateFile, saltStateJSON, 0644)
-	if err != nil {
-		log.Printf("failed to save salt JSON to file: %v\n", err)
+	for attempt := 1; attempt <= stateWriteAttempts; attempt++ {
+		err = writeFile(saltUpdateFile, saltStateJSON)
+		if err == nil {
+			return nil
+		}
+		log.Printf("failed to save salt JSON to file (attempt %d/%d): %v\n", attempt, stateWriteAttempts, err)
+		if attempt < stateWriteAttempts {
+			time.Sleep(stateWriteRetryDelay)
+		}
 	}
-	return err
+	return fmt.Errorf("failed to save salt state to %s after %d attempts: %w", saltUpdateFile, stateWriteAttempts, err)
+}
+
+const stateWriteAttempts = 3
 
+// stateWriteRetryDelay is how long to wait before trying to write the state file again, a var so tests can change it.
+var stateWriteRetryDelay = 500 * time.Millisecond
+
+// writeFile is used to write the state file, a var so tests can simulate write errors.
+var writeFile = WriteFileAtomic
+
+// WriteFileAtomic writes to a temporary file then renames it so the file is never left partly written.
+// The temporary file is synced before the rename so a reboot or power cut straight after doesn't
+// leave an empty file.
+func WriteFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
 }
+
+// ReadStateFile reads the salt state from the state file, writing an empty state if there is no file.
 func ReadStateFile() (*SaltState, error) {
 	saltState := &SaltState{}
 
@@ -186,73 +820,476 @@ func ReadStateFile() (*SaltState, error) {
 	return saltState, err
 }
 
+// StateFromFile reads the salt state directly from the state file without needing the dbus service.
+// This is a best effort snapshot of the last saved state and may be stale, the progress fields are
+// only saved at the end of a salt call so RunningUpdate being true may mean the service was stopped
+// during a salt call. If no state has been saved an empty state is returned.
+func StateFromFile() (*SaltState, error) {
+	saltState := &SaltState{}
+	data, err := os.ReadFile(saltUpdateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return saltState, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, saltState); err != nil {
+		return nil, err
+	}
+	return saltState, nil
+}
+
 func UpdateExists() (bool, time.Time, error) {
-	nodegroupOut, err := os.ReadFile("/etc/cacophony/salt-nodegroup")
+	updateAvailable, info, err := UpdateExistsWithInfo(ChannelStable)
+	if info == nil {
+		return updateAvailable, time.Time{}, err
+	}
+	return updateAvailable, info.CommitDate, err
+}
+
+// UpdateExistsWithInfo checks if there is an update for this minions nodegroup, on the given
+// channel, and returns the details of the latest version. See IsUpdateAvailable for how the
+// latest version is compared to the last update.
+func UpdateExistsWithInfo(channel string) (bool, *UpdateInfo, error) {
+	nodegroup, err := ReadNodegroup()
+	if err != nil {
+		return false, nil, err
+	}
+
+	branch, err := ResolveBranch(nodegroup, channel)
 	if err != nil {
-		return false, time.Time{}, err
+		return false, nil, err
 	}
+	return UpdateExistsForBranch(branch)
+}
+
+// UpdateExistsForBranch checks if there is an update on the given saltops branch, and returns
+// the details of the latest version.
+func UpdateExistsForBranch(branch string) (bool, *UpdateInfo, error) {
 	saltState, _ := ReadStateFile()
+	info, err := GetBranchUpdateInfo(branch)
+	if err != nil {
+		return false, nil, err
+	}
+
+	return IsUpdateAvailable(info, saltState), info, nil
+}
 
-	updateTime, err := GetLatestUpdateTime(string(nodegroupOut))
+// IsUpdateAvailable compares the latest saltops commit to the last successful update.
+// The commit SHAs are compared when both are known, as the commit date can look old or new
+// with clock skew on the device or a force push. If the SHA isn't known the versions are
+// compared, falling back to comparing the commit date with the last update time.
+func IsUpdateAvailable(info *UpdateInfo, state *SaltState) bool {
+	if info.CommitSHA != "" && state.LastUpdateSHA != "" {
+		return info.CommitSHA != state.LastUpdateSHA
+	}
+	if info.Version != "" && state.LastUpdateVersion != "" {
+		return info.Version != state.LastUpdateVersion
+	}
+	return info.CommitDate.After(state.LastUpdate)
+}
+
+// UpdateExistsForRef checks if the given saltops ref (branch or tag) has been
+// updated since the last update.
+func UpdateExistsForRef(ref string) (bool, *UpdateInfo, error) {
+	saltState, _ := ReadStateFile()
+
+	info, err := GetRefUpdateInfo(ref)
 	if err != nil {
-		return false, updateTime, err
+		return false, nil, err
 	}
 
-	return updateTime.After(saltState.LastUpdate), updateTime, nil
+	return IsUpdateAvailable(info, saltState), info, nil
+}
+
+// GetRefUpdateInfo uses the github api to get the commit of the given saltops ref.
+func GetRefUpdateInfo(ref string) (*UpdateInfo, error) {
+	log.Printf("Checking for updates for saltops %v ref", ref)
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(CommitsURL + url.PathEscape(ref))
+	if err != nil {
+		if isOfflineError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrOffline, err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("bad update status check %v for saltops ref %v", resp.StatusCode, ref)
+	}
+
+	var commit struct {
+		SHA    string `json:"sha"`
+		Commit struct {
+			Committer struct {
+				Date time.Time `json:"date"`
+			} `json:"committer"`
+		} `json:"commit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&commit); err != nil {
+		return nil, err
+	}
+	if commit.Commit.Committer.Date.IsZero() {
+		return nil, fmt.Errorf("could not find commit date for saltops ref %v", ref)
+	}
+	return &UpdateInfo{
+		Branch:     ref,
+		CommitSHA:  commit.SHA,
+		CommitDate: commit.Commit.Committer.Date,
+	}, nil
+}
+
+// UpdateInfo holds the details of the latest saltops version for a branch.
+type UpdateInfo struct {
+	Branch     string
+	Version    string
+	CommitSHA  string
+	CommitDate time.Time
 }
 
-// UpdateExists checks if there has been any git updates since the last update time for this minions nodegroup
-// uses github api to view last commit to the repo
+// GetLatestUpdateTime returns the time of the latest commit to the saltops branch for the nodegroup.
 func GetLatestUpdateTime(nodeGroup string) (time.Time, error) {
+	info, err := GetLatestUpdateInfo(nodeGroup)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.CommitDate, nil
+}
 
-	nodeGroup = strings.TrimSuffix(nodeGroup, "\n")
-	branch, ok := nodeGroupToBranch[nodeGroup]
-	var updateTime time.Time
+// GetLatestUpdateInfo gets the details of the latest saltops version for this minions nodegroup
+// from the salt-version-info json.
+func GetLatestUpdateInfo(nodeGroup string) (*UpdateInfo, error) {
+	branch, err := ResolveBranch(nodeGroup, ChannelStable)
+	if err != nil {
+		return nil, err
+	}
+	return GetBranchUpdateInfo(branch)
+}
 
-	if !ok {
-		return updateTime, fmt.Errorf("cant find a salt branch  mapping for %v nodegroup", nodeGroup)
+// HTTPProxy is the proxy URL used when checking for updates. If empty the proxy is
+// taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+var HTTPProxy = ""
+
+// UserAgent is sent with requests when checking for updates, GitHub needs one set.
+// salt-helper adds its version to it.
+var UserAgent = "cacophony-salt-updater"
+
+// userAgentTransport sets the User-Agent header on every request.
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", UserAgent)
+	return t.base.RoundTrip(req)
+}
+
+const defaultHTTPTimeout = 10 * time.Second
+
+// HTTPTimeout is the total timeout for requests when checking for updates, including reading the
+// response. A timeout of 0 or less uses the default so a request can't hang forever.
+var HTTPTimeout = defaultHTTPTimeout
+
+const defaultHTTPConnectTimeout = 5 * time.Second
+
+// HTTPConnectTimeout is the timeout for connecting to the server when checking for updates,
+// a timeout of 0 or less uses the default.
+var HTTPConnectTimeout = defaultHTTPConnectTimeout
+
+// DefaultVersionInfoURL and DefaultCommitsURL are the GitHub URLs used when no mirror is set.
+const (
+	DefaultVersionInfoURL = saltVersionUrl
+	DefaultCommitsURL     = saltopsCommitsUrl
+)
+
+// VersionInfoURL is where the salt version info is read from, it can be changed to use a mirror.
+var VersionInfoURL = DefaultVersionInfoURL
+
+// CommitsURL is the base URL for getting the latest commit of a saltops ref, it can be changed to use a mirror.
+var CommitsURL = DefaultCommitsURL
+
+// newHTTPClient makes the client used when checking for updates, using HTTPProxy if set and sending UserAgent.
+func newHTTPClient() (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if HTTPProxy != "" {
+		proxyURL, err := url.Parse(HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http proxy '%s': %v", HTTPProxy, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	connectTimeout := HTTPConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultHTTPConnectTimeout
 	}
+	// The dialer tries IPv6 and IPv4 addresses in parallel, falling back quickly if one doesn't work.
+	dialer := &net.Dialer{
+		Timeout:       connectTimeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: 300 * time.Millisecond,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	timeout := HTTPTimeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	transport.ResponseHeaderTimeout = timeout
+	return &http.Client{Transport: userAgentTransport{base: transport}, Timeout: timeout}, nil
+}
+
+// UpdateCheckCacheTTL is how long the result of checking for the latest version of a branch
+// is reused for, so repeated update checks don't each make a request. The results are saved
+// next to the state file so they are shared by the dbus service and commands like
+// check-for-update. 0 disables the cache.
+var UpdateCheckCacheTTL = 5 * time.Minute
+
+type cachedUpdateInfo struct {
+	Info      UpdateInfo
+	FetchedAt time.Time
+}
+
+// fresh returns true if the cached update check can still be used. A check from the future,
+// e.g. after the clock was corrected, isn't used.
+func (c cachedUpdateInfo) fresh() bool {
+	age := time.Since(c.FetchedAt)
+	return age >= 0 && age < UpdateCheckCacheTTL
+}
+
+var (
+	updateInfoCache   = map[string]cachedUpdateInfo{}
+	updateInfoCacheMu sync.Mutex
+	// updateCheckCacheFileMu stops two saves in this process losing each other's checks. It is
+	// separate from updateInfoCacheMu so the in memory cache isn't locked during file I/O.
+	updateCheckCacheFileMu sync.Mutex
+)
+
+// updateCheckCacheFile is where the cached update checks are saved, next to the state file.
+func updateCheckCacheFile() string {
+	return filepath.Join(filepath.Dir(saltUpdateFile), "salt-update-check-cache.json")
+}
+
+// readUpdateCheckCache reads the saved update checks, keyed by branch. The cache is empty if it
+// can't be read.
+func readUpdateCheckCache() map[string]cachedUpdateInfo {
+	cache := map[string]cachedUpdateInfo{}
+	data, err := os.ReadFile(updateCheckCacheFile())
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Ignoring invalid update check cache: %v", err)
+		return map[string]cachedUpdateInfo{}
+	}
+	return cache
+}
+
+// saveUpdateCheck adds the update check for the branch to the saved cache. Failing to save it
+// only means the next process checks again, e.g. when a command isn't run as root.
+func saveUpdateCheck(branch string, cached cachedUpdateInfo) {
+	updateCheckCacheFileMu.Lock()
+	defer updateCheckCacheFileMu.Unlock()
+	cache := readUpdateCheckCache()
+	cache[branch] = cached
+	data, err := json.Marshal(cache)
+	if err == nil {
+		err = WriteFileAtomic(updateCheckCacheFile(), data)
+	}
+	if err != nil {
+		log.Debugf("Failed to save update check cache: %v", err)
+	}
+}
+
+// ClearUpdateCache removes the cached update checks so the next check makes a new request.
+func ClearUpdateCache() {
+	updateInfoCacheMu.Lock()
+	updateInfoCache = map[string]cachedUpdateInfo{}
+	versionInfoCache = nil
+	updateInfoCacheMu.Unlock()
+	updateCheckCacheFileMu.Lock()
+	defer updateCheckCacheFileMu.Unlock()
+	if err := os.Remove(updateCheckCacheFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove update check cache: %v", err)
+	}
+}
+
+// GetBranchUpdateInfo gets the details of the latest saltops version for the branch
+// from the salt-version-info json. Results are cached for UpdateCheckCacheTTL.
+func GetBranchUpdateInfo(branch string) (*UpdateInfo, error) {
+	updateInfoCacheMu.Lock()
+	cached, ok := updateInfoCache[branch]
+	updateInfoCacheMu.Unlock()
+	if UpdateCheckCacheTTL > 0 && !(ok && cached.fresh()) {
+		// Another process could have checked since, e.g. the dbus service.
+		cached, ok = readUpdateCheckCache()[branch]
+	}
+	if ok && cached.fresh() {
+		log.Printf("Using cached update check for saltops %v branch", branch)
+		info := cached.Info
+		return &info, nil
+	}
+
+	info, err := fetchBranchUpdateInfo(branch)
+	if err != nil {
+		return nil, err
+	}
+	cached = cachedUpdateInfo{Info: *info, FetchedAt: time.Now()}
+	updateInfoCacheMu.Lock()
+	updateInfoCache[branch] = cached
+	updateInfoCacheMu.Unlock()
+	if UpdateCheckCacheTTL > 0 {
+		saveUpdateCheck(branch, cached)
+	}
+	return info, nil
+}
+
+func fetchBranchUpdateInfo(branch string) (*UpdateInfo, error) {
 	log.Printf("Checking for updates for saltops %v branch", branch)
-	resp, err := http.Get(saltVersionUrl)
+	details, err := fetchVersionInfo()
+	if err != nil {
+		return nil, err
+	}
+	return parseBranchUpdateInfo(details, branch)
+}
 
+// fetchVersionInfo reads the salt-version-info json from VersionInfoURL.
+func fetchVersionInfo() (map[string]interface{}, error) {
+	client, err := newHTTPClient()
 	if err != nil {
-		return updateTime, err
+		return nil, err
+	}
+	resp, err := client.Get(VersionInfoURL)
+	if err != nil {
+		if isOfflineError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrOffline, err)
+		}
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return updateTime, fmt.Errorf("bad update status check %v from url %v", resp.StatusCode, saltVersionUrl)
+		return nil, fmt.Errorf("bad update status check %v from url %v", resp.StatusCode, VersionInfoURL)
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return updateTime, err
+		return nil, err
 
 	}
 	var details map[string]interface{}
 	err = json.Unmarshal(body, &details)
 	if err != nil {
-		return updateTime, err
+		return nil, err
 	}
+	return details, nil
+}
 
-	var commitDate string
-	if branchDetails, ok := details[branch]; ok {
-		if tc2, ok := branchDetails.(map[string]interface{})["tc2"]; ok {
-			if commitDate, ok = tc2.(map[string]interface{})["commitDate"].(string); !ok {
-				err = fmt.Errorf("could not find commitDate key in json %v", commitDate)
-			}
-		} else {
-			err = fmt.Errorf("could not find tc2 key in json %v", branchDetails)
-		}
-	} else {
-		err = fmt.Errorf("could not find %v key in json %v", branch, details)
+// parseBranchUpdateInfo gets the details of the latest version of the branch from the salt-version-info json.
+// Errors only name the branch, not the json, so they stay short in logs.
+func parseBranchUpdateInfo(details map[string]interface{}, branch string) (*UpdateInfo, error) {
+	branchDetails, ok := details[branch]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrBranchNotFound, branch)
 	}
-	if err != nil {
-		return updateTime, err
+	branchMap, ok := branchDetails.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid version info for saltops %v branch", branch)
 	}
+	tc2, ok := branchMap["tc2"]
+	if !ok {
+		return nil, fmt.Errorf("could not find tc2 version info for saltops %v branch", branch)
+	}
+	tc2Details, ok := tc2.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid tc2 version info for saltops %v branch", branch)
+	}
+	commitDate, ok := tc2Details["commitDate"].(string)
+	if !ok {
+		return nil, fmt.Errorf("could not find commitDate in tc2 version info for saltops %v branch", branch)
+	}
+	// Not all branches have a version or SHA, in that case only the commit date is used.
+	version, _ := tc2Details["version"].(string)
+	commitSHA, _ := tc2Details["commitSHA"].(string)
 	layout := "2006-01-02T15:04:05Z"
-	updateTime, err = time.Parse(layout, commitDate)
+	updateTime, err := time.Parse(layout, commitDate)
 	if err != nil {
-		return updateTime, err
+		return nil, err
 	}
 
-	return updateTime, nil
+	return &UpdateInfo{
+		Branch:     branch,
+		Version:    version,
+		CommitSHA:  commitSHA,
+		CommitDate: updateTime,
+	}, nil
+}
+
+var (
+	versionInfoCache          map[string]interface{}
+	versionInfoCacheFetchedAt time.Time
+)
+
+// knownBranches returns the saltops branches used by the known nodegroups on any channel, sorted.
+func knownBranches() []string {
+	seen := map[string]bool{}
+	for _, branch := range nodeGroupToBranch {
+		seen[branch] = true
+	}
+	for _, branch := range betaBranches {
+		seen[branch] = true
+	}
+	branches := make([]string, 0, len(seen))
+	for branch := range seen {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	return branches
+}
+
+// LatestVersions returns the latest saltops version of every known branch, keyed by branch.
+// The salt-version-info json is fetched once for all branches and reused for UpdateCheckCacheTTL.
+// Branches missing from the json are left out.
+func LatestVersions() (map[string]UpdateInfo, error) {
+	updateInfoCacheMu.Lock()
+	details := versionInfoCache
+	fresh := details != nil && time.Since(versionInfoCacheFetchedAt) < UpdateCheckCacheTTL
+	updateInfoCacheMu.Unlock()
+	if !fresh {
+		log.Println("Checking for the latest versions of all saltops branches")
+		var err error
+		details, err = fetchVersionInfo()
+		if err != nil {
+			return nil, err
+		}
+		updateInfoCacheMu.Lock()
+		versionInfoCache = details
+		versionInfoCacheFetchedAt = time.Now()
+		updateInfoCacheMu.Unlock()
+	}
+
+	versions := map[string]UpdateInfo{}
+	for _, branch := range knownBranches() {
+		info, err := parseBranchUpdateInfo(details, branch)
+		if err != nil {
+			log.Printf("No version info for saltops %v branch: %v", branch, err)
+			continue
+		}
+		versions[branch] = *info
+	}
+	return versions, nil
+}
+
+// isOfflineError checks if the error was caused by the network being unreachable or DNS failing.
+func isOfflineError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	// A refused connection is left out, the network is up and it is a problem with the server or proxy.
+	return errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH)
 }
@@ -0,0 +1,440 @@
+package saltrequester
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateFromFile(t *testing.T) {
+	saltUpdateFile = filepath.Join(t.TempDir(), "saltUpdate.json")
+
+	state, err := StateFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, &SaltState{}, state)
+	_, err = os.Stat(saltUpdateFile)
+	assert.True(t, os.IsNotExist(err), "reading the state should not create the file")
+
+	lastUpdate := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, WriteStateFile(&SaltState{
+		LastCallSuccess:   true,
+		LastCallNodegroup: "tc2-prod",
+		LastUpdate:        lastUpdate,
+	}))
+	state, err = StateFromFile()
+	assert.NoError(t, err)
+	assert.True(t, state.LastCallSuccess)
+	assert.Equal(t, "tc2-prod", state.LastCallNodegroup)
+	assert.True(t, lastUpdate.Equal(state.LastUpdate))
+
+	assert.NoError(t, os.WriteFile(saltUpdateFile, []byte("not json"), 0644))
+	_, err = StateFromFile()
+	assert.Error(t, err)
+}
+
+func TestResolveBranch(t *testing.T) {
+	cases := []struct {
+		nodegroup, channel, branch string
+	}{
+		{"tc2-prod", "", "prod"},
+		{"tc2-prod", ChannelStable, "prod"},
+		{"tc2-prod", ChannelBeta, "test"},
+		{"test-pis", ChannelBeta, "dev"},
+		{"tc2-dev", ChannelBeta, "dev"},
+	}
+	for _, c := range cases {
+		branch, err := ResolveBranch(c.nodegroup, c.channel)
+		assert.NoError(t, err)
+		assert.Equal(t, c.branch, branch, "%s on %s channel", c.nodegroup, c.channel)
+	}
+
+	_, err := ResolveBranch("tc2-unknown", ChannelStable)
+	assert.ErrorIs(t, err, ErrUnknownNodegroup)
+
+	_, err = ResolveBranch("tc2-prod", "alpha")
+	assert.Error(t, err)
+}
+
+func TestGetBranchUpdateInfoCache(t *testing.T) {
+	SetStateFile(filepath.Join(t.TempDir(), "saltUpdate.json"))
+	defer SetStateFile("/etc/cacophony/saltUpdate.json")
+	defer ClearUpdateCache()
+	commitDate := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	updateInfoCache["prod"] = cachedUpdateInfo{
+		Info:      UpdateInfo{Branch: "prod", Version: "v1.2.3", CommitDate: commitDate},
+		FetchedAt: time.Now(),
+	}
+
+	info, err := GetBranchUpdateInfo("prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.Equal(t, commitDate, info.CommitDate)
+
+	ClearUpdateCache()
+	assert.Empty(t, updateInfoCache)
+}
+
+func TestGetBranchUpdateInfoSharedCache(t *testing.T) {
+	SetStateFile(filepath.Join(t.TempDir(), "saltUpdate.json"))
+	defer SetStateFile("/etc/cacophony/saltUpdate.json")
+	defer ClearUpdateCache()
+	requests := 0
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"prod": {"tc2": {"commitDate": "2024-05-01T12:00:00Z", "version": "v1.2.3"}}}`))
+	}))
+	defer mirror.Close()
+	VersionInfoURL = mirror.URL
+	defer func() { VersionInfoURL = saltVersionUrl }()
+
+	_, err := GetBranchUpdateInfo("prod")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+
+	// Another process, with nothing cached in memory, uses the saved check.
+	updateInfoCache = map[string]cachedUpdateInfo{}
+	info, err := GetBranchUpdateInfo("prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.Equal(t, 1, requests)
+
+	// Clearing the cache, e.g. for a forced update, also clears the saved checks.
+	ClearUpdateCache()
+	_, err = GetBranchUpdateInfo("prod")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	// A check from the future isn't used.
+	updateInfoCache["prod"] = cachedUpdateInfo{Info: UpdateInfo{Version: "v0.0.1"}, FetchedAt: time.Now().Add(time.Hour)}
+	saveUpdateCheck("prod", updateInfoCache["prod"])
+	info, err = GetBranchUpdateInfo("prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.Equal(t, 3, requests)
+}
+
+func TestIsUpdateAvailable(t *testing.T) {
+	lastUpdate := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	state := &SaltState{LastUpdate: lastUpdate, LastUpdateSHA: "abc123", LastUpdateVersion: "v1.2.3"}
+
+	// A new commit with an older commit date is still an update.
+	older := &UpdateInfo{CommitSHA: "def456", CommitDate: lastUpdate.Add(-time.Hour)}
+	assert.True(t, IsUpdateAvailable(older, state))
+
+	// The same commit with a newer commit date is not an update.
+	same := &UpdateInfo{CommitSHA: "abc123", Version: "v1.2.4", CommitDate: lastUpdate.Add(time.Hour)}
+	assert.False(t, IsUpdateAvailable(same, state))
+
+	// Without a SHA the versions are compared.
+	assert.True(t, IsUpdateAvailable(&UpdateInfo{Version: "v1.2.4"}, state))
+	assert.False(t, IsUpdateAvailable(&UpdateInfo{Version: "v1.2.3", CommitDate: lastUpdate.Add(time.Hour)}, state))
+
+	// Without a SHA or version the commit date is compared.
+	assert.True(t, IsUpdateAvailable(&UpdateInfo{CommitDate: lastUpdate.Add(time.Hour)}, &SaltState{LastUpdate: lastUpdate}))
+	assert.False(t, IsUpdateAvailable(&UpdateInfo{CommitSHA: "def456", CommitDate: lastUpdate.Add(-time.Hour)}, &SaltState{LastUpdate: lastUpdate}))
+}
+
+func TestNewHTTPClientUsesProxy(t *testing.T) {
+	var proxiedURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedURL = r.URL.String()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	HTTPProxy = proxy.URL
+	defer func() { HTTPProxy = "" }()
+
+	client, err := newHTTPClient()
+	assert.NoError(t, err)
+	resp, err := client.Get("http://saltops.invalid/version-info.json")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "http://saltops.invalid/version-info.json", proxiedURL)
+
+	HTTPProxy = "://bad"
+	_, err = newHTTPClient()
+	assert.Error(t, err)
+}
+
+func TestWriteStateFileRetry(t *testing.T) {
+	saltUpdateFile = filepath.Join(t.TempDir(), "saltUpdate.json")
+	defer func(delay time.Duration) { stateWriteRetryDelay = delay }(stateWriteRetryDelay)
+	stateWriteRetryDelay = 0
+	attempts := 0
+	writeFile = func(path string, data []byte) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("device or resource busy")
+		}
+		return WriteFileAtomic(path, data)
+	}
+	defer func() { writeFile = WriteFileAtomic }()
+
+	state := &SaltState{LastCallSuccess: true}
+	assert.NoError(t, WriteStateFile(state))
+	assert.Equal(t, 2, attempts)
+
+	saved, err := StateFromFile()
+	assert.NoError(t, err)
+	assert.True(t, saved.LastCallSuccess)
+
+	writeFile = func(path string, data []byte) error {
+		return errors.New("read-only file system")
+	}
+	assert.Error(t, WriteStateFile(state))
+	assert.True(t, state.LastCallSuccess)
+}
+
+func TestFetchBranchUpdateInfoFromMirror(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"prod": {"tc2": {"commitDate": "2024-05-01T12:00:00Z", "version": "v1.2.3"}}}`))
+	}))
+	defer mirror.Close()
+
+	VersionInfoURL = mirror.URL
+	defer func() { VersionInfoURL = saltVersionUrl }()
+
+	info, err := fetchBranchUpdateInfo("prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.Equal(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), info.CommitDate.UTC())
+}
+
+func TestParseBranchUpdateInfoErrors(t *testing.T) {
+	details := map[string]interface{}{
+		"prod":       map[string]interface{}{"tc2": map[string]interface{}{"commitDate": "2024-05-01T12:00:00Z"}},
+		"not-a-map":  "prod",
+		"no-tc2":     map[string]interface{}{"pi": map[string]interface{}{}},
+		"bad-tc2":    map[string]interface{}{"tc2": []interface{}{}},
+		"no-date":    map[string]interface{}{"tc2": map[string]interface{}{"version": "v1.2.3"}},
+		"bad-date":   map[string]interface{}{"tc2": map[string]interface{}{"commitDate": "yesterday"}},
+		"number-key": map[string]interface{}{"tc2": map[string]interface{}{"commitDate": 12}},
+	}
+	_, err := parseBranchUpdateInfo(details, "prod-canary")
+	assert.ErrorIs(t, err, ErrBranchNotFound)
+	assert.Contains(t, err.Error(), "prod-canary")
+
+	// Unexpected json is an error, not a panic, and the error doesn't include the json.
+	for _, branch := range []string{"not-a-map", "no-tc2", "bad-tc2", "no-date", "bad-date", "number-key"} {
+		_, err := parseBranchUpdateInfo(details, branch)
+		assert.Error(t, err, branch)
+		assert.NotErrorIs(t, err, ErrBranchNotFound, branch)
+		assert.NotContains(t, err.Error(), "map[", branch)
+	}
+}
+
+func TestLatestVersions(t *testing.T) {
+	requests := 0
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{
+			"prod": {"tc2": {"commitDate": "2024-05-01T12:00:00Z", "version": "v1.2.3"}},
+			"test": {"tc2": {"commitDate": "2024-05-02T12:00:00Z", "version": "v1.3.0", "commitSHA": "abc123"}}
+		}`))
+	}))
+	defer mirror.Close()
+
+	VersionInfoURL = mirror.URL
+	defer func() { VersionInfoURL = saltVersionUrl }()
+	defer ClearUpdateCache()
+
+	versions, err := LatestVersions()
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "v1.2.3", versions["prod"].Version)
+	assert.Equal(t, "abc123", versions["test"].CommitSHA)
+	assert.Equal(t, time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC), versions["test"].CommitDate.UTC())
+
+	// The json is reused until the cache is cleared.
+	_, err = LatestVersions()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+
+	ClearUpdateCache()
+	_, err = LatestVersions()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+}
+
+func TestIsOfflineError(t *testing.T) {
+	assert.True(t, isOfflineError(&net.DNSError{Err: "no such host", Name: "raw.githubusercontent.com"}))
+	assert.True(t, isOfflineError(&net.OpError{Op: "dial", Err: syscall.ENETUNREACH}))
+	assert.True(t, isOfflineError(&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}))
+	// A refused connection means the network is up, it is a server or proxy problem.
+	assert.False(t, isOfflineError(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}))
+	assert.False(t, isOfflineError(errors.New("bad update status check 500")))
+}
+
+func TestNodegroupWhitespace(t *testing.T) {
+	assert.Equal(t, "dev-pis", NormalizeNodegroup("dev-pis \r\n"))
+
+	branch, ok := NodegroupBranch("dev-pis \r\n")
+	assert.True(t, ok)
+	assert.Equal(t, "dev", branch)
+
+	branch, err := ResolveBranch("dev-pis \r\n", ChannelStable)
+	assert.NoError(t, err)
+	assert.Equal(t, "dev", branch)
+}
+
+func TestNewHTTPClientUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	UserAgent = "cacophony-salt-updater/v1.2.3"
+	defer func() { UserAgent = "cacophony-salt-updater" }()
+
+	client, err := newHTTPClient()
+	assert.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "cacophony-salt-updater/v1.2.3", userAgent)
+}
+
+func TestNewHTTPClientTimeout(t *testing.T) {
+	// The server accepts the connection but never responds.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conns := []net.Conn{}
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	HTTPTimeout = 200 * time.Millisecond
+	defer func() { HTTPTimeout = defaultHTTPTimeout }()
+
+	client, err := newHTTPClient()
+	assert.NoError(t, err)
+	start := time.Now()
+	_, err = client.Get("http://" + listener.Addr().String())
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// fakeBusObject replies to dbus calls with the reply for the method, recording the calls made.
+type fakeBusObject struct {
+	replies map[string][]interface{}
+	errs    map[string]error
+	calls   []string
+	args    [][]interface{}
+}
+
+func (f *fakeBusObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	f.calls = append(f.calls, method)
+	f.args = append(f.args, args)
+	return &dbus.Call{Method: method, Args: args, Body: f.replies[method], Err: f.errs[method]}
+}
+
+func useFakeBusObject(t *testing.T, fake *fakeBusObject) {
+	getDbusObj = func() (busObject, error) { return fake, nil }
+	t.Cleanup(func() { getDbusObj = systemBusObj })
+}
+
+func TestStateOverDbus(t *testing.T) {
+	state := SaltState{
+		LastCallOut:         "Succeeded: 106 (changed=5)",
+		LastCallSuccess:     true,
+		LastCallNodegroup:   "tc2-prod",
+		LastUpdate:          time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+		LastTrigger:         TriggerScheduled,
+		ConsecutiveFailures: 1,
+		LastChanges:         []ChangeItem{{ID: "stay-on", Function: "cmd.run", Name: "systemctl restart stay-on"}},
+	}
+	stateJSON, err := json.Marshal(state)
+	assert.NoError(t, err)
+	fake := &fakeBusObject{replies: map[string][]interface{}{
+		methodBase + ".State":       {stateJSON},
+		methodBase + ".RunPingSync": {stateJSON},
+	}}
+	useFakeBusObject(t, fake)
+
+	got, err := State()
+	assert.NoError(t, err)
+	assert.Equal(t, &state, got)
+
+	got, err = RunPingSync()
+	assert.NoError(t, err)
+	assert.Equal(t, &state, got)
+	assert.Equal(t, []string{methodBase + ".State", methodBase + ".RunPingSync"}, fake.calls)
+}
+
+func TestStateOverDbusErrors(t *testing.T) {
+	fake := &fakeBusObject{
+		replies: map[string][]interface{}{methodBase + ".State": {[]byte("not json")}},
+		errs:    map[string]error{methodBase + ".RunPingSync": errors.New("salt call already running")},
+	}
+	useFakeBusObject(t, fake)
+
+	_, err := State()
+	assert.Error(t, err)
+	_, err = RunPingSync()
+	assert.EqualError(t, err, "salt call already running")
+}
+
+func TestIsRunningOverDbus(t *testing.T) {
+	fake := &fakeBusObject{replies: map[string][]interface{}{methodBase + ".IsRunning": {true}}}
+	useFakeBusObject(t, fake)
+	running, err := IsRunning()
+	assert.NoError(t, err)
+	assert.True(t, running)
+
+	fake.errs = map[string]error{methodBase + ".IsRunning": errors.New("service not running")}
+	running, err = IsRunning()
+	assert.Error(t, err)
+	assert.False(t, running)
+}
+
+func TestRunUpdateOverDbus(t *testing.T) {
+	fake := &fakeBusObject{replies: map[string][]interface{}{
+		methodBase + ".RunUpdate":    {},
+		methodBase + ".RunUpdateJob": {"3f2a9c1d5e6b7a80"},
+		methodBase + ".JobStatus":    {[]byte(`{"ID":"3f2a9c1d5e6b7a80","State":"running","ProgressPercentage":40}`)},
+	}}
+	useFakeBusObject(t, fake)
+
+	assert.NoError(t, RunUpdate())
+
+	jobID, err := RunUpdateJob()
+	assert.NoError(t, err)
+	assert.Equal(t, "3f2a9c1d5e6b7a80", jobID)
+
+	job, err := JobStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, JobRunning, job.State)
+	assert.Equal(t, 40, job.ProgressPercentage)
+	assert.Equal(t, []interface{}{jobID}, fake.args[2])
+}
+
+func TestReloadConfigOverDbus(t *testing.T) {
+	fake := &fakeBusObject{}
+	useFakeBusObject(t, fake)
+	assert.NoError(t, ReloadConfig())
+	assert.Equal(t, []string{methodBase + ".ReloadConfig"}, fake.calls)
+}